@@ -0,0 +1,229 @@
+package mapreduce
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// a named pair of user Map/Reduce functions that the master can
+// select per job and workers look up by name. Combine is optional;
+// it pre-aggregates one map task's values for a key and must be
+// safe to apply before Reduce (e.g. an associative reducer like WCReduce).
+// Partition is optional too; it picks the reduce task for a key in
+// jobs with AppPartition, and must return one in [0, nreduce), or the
+// map task fails. CountingMap and CountingReduce, if set, are
+// used instead of Map and Reduce, and can report Counters.
+type App struct {
+	Map            func(string) []KeyValue
+	Reduce         func(string, []string) string
+	Combine        func(string, []string) string
+	Partition      func(key string, nreduce int) int
+	CountingMap    func(value string, counters Counters) []KeyValue
+	CountingReduce func(key string, values []string, counters Counters) string
+}
+
+// builds an App from the job's parameter string (e.g. grep's pattern);
+// apps that take no parameter ignore it.
+type AppMaker func(param string) (App, error)
+
+var (
+	appsMu sync.Mutex
+	apps   = make(map[string]AppMaker)
+)
+
+// make an app available to masters and workers under name.
+// call from an init() so every process sees the same registry.
+func RegisterApp(name string, maker AppMaker) {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+	if _, exist := apps[name]; exist {
+		panic("RegisterApp: duplicate app " + name)
+	}
+	apps[name] = maker
+}
+
+// look up a registered app and build it with param.
+func LookupApp(name string, param string) (App, error) {
+	appsMu.Lock()
+	maker, ok := apps[name]
+	appsMu.Unlock()
+	if !ok {
+		return App{}, fmt.Errorf("unknown app %q", name)
+	}
+	return maker(param)
+}
+
+func init() {
+	RegisterApp("wc", makeWC)
+	RegisterApp("grep", makeGrep)
+	RegisterApp("inverted-index", func(string) (App, error) {
+		return App{Map: IIMap, Reduce: IIReduce}, nil
+	})
+	RegisterApp("distinct", func(string) (App, error) {
+		return App{Map: DistinctMap, Reduce: DistinctReduce, Combine: DistinctReduce}, nil
+	})
+	RegisterApp("top-k", makeTopK)
+}
+
+// word count: param configures how the input is split into words, as
+// for WCMapWith.
+func makeWC(param string) (App, error) {
+	mapF, err := WCMapWith(param)
+	if err != nil {
+		return App{}, err
+	}
+	countingMap := func(value string, counters Counters) []KeyValue {
+		intermediate := mapF(value)
+		counters.Add(WCWords, int64(len(intermediate)))
+		return intermediate
+	}
+	return App{Map: mapF, Reduce: WCReduce, Combine: WCReduce,
+		CountingMap: countingMap, CountingReduce: WCReduceCounting}, nil
+}
+
+// grep: param is a regular expression; the output is every matching
+// line together with the number of times it occurs in the input.
+func makeGrep(param string) (App, error) {
+	re, err := regexp.Compile(param)
+	if err != nil {
+		return App{}, err
+	}
+	grepMap := func(value string) []KeyValue {
+		intermediate := make([]KeyValue, 0)
+		for _, line := range strings.Split(value, "\n") {
+			if line != "" && re.MatchString(line) {
+				intermediate = append(intermediate, KeyValue{Key: line, Value: "1"})
+			}
+		}
+		return intermediate
+	}
+	return App{Map: grepMap, Reduce: WCReduce, Combine: WCReduce}, nil
+}
+
+// inverted index: every input line is a document whose first field is
+// its name; emits (word, document) once per word and document.
+func IIMap(value string) []KeyValue {
+	intermediate := make([]KeyValue, 0)
+	notLetter := func(r rune) bool { return !unicode.IsLetter(r) }
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		doc := fields[0]
+		seen := make(map[string]bool)
+		for _, w := range strings.FieldsFunc(strings.Join(fields[1:], " "), notLetter) {
+			if !seen[w] {
+				seen[w] = true
+				intermediate = append(intermediate, KeyValue{Key: w, Value: doc})
+			}
+		}
+	}
+	return intermediate
+}
+
+// the number of documents containing key followed by their sorted names,
+// e.g. "2 a.txt,b.txt".
+func IIReduce(key string, values []string) string {
+	docs := make(map[string]bool)
+	for _, v := range values {
+		docs[v] = true
+	}
+	sorted := make([]string, 0, len(docs))
+	for d := range docs {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	return strconv.Itoa(len(sorted)) + " " + strings.Join(sorted, ",")
+}
+
+// distinct: the set of unique non-empty input lines.
+func DistinctMap(value string) []KeyValue {
+	intermediate := make([]KeyValue, 0)
+	for _, line := range strings.Split(value, "\n") {
+		if line != "" {
+			intermediate = append(intermediate, KeyValue{Key: line, Value: ""})
+		}
+	}
+	return intermediate
+}
+
+func DistinctReduce(key string, values []string) string {
+	return ""
+}
+
+// top-k: meant as a later pipeline stage, its input is "key\tcount"
+// lines such as word count's output; param is k (default 10). every
+// split's k largest counts go to a single key, whose value is the
+// overall k largest as "key=count" pairs, largest first.
+func makeTopK(param string) (App, error) {
+	k := 10
+	if param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			return App{}, fmt.Errorf("top-k: bad k %q", param)
+		}
+		k = n
+	}
+	topMap := func(value string) []KeyValue {
+		counts := make([]KeyValue, 0)
+		for _, line := range strings.Split(value, "\n") {
+			key, count, found := strings.Cut(line, "\t")
+			if found {
+				counts = append(counts, KeyValue{Key: key, Value: count})
+			}
+		}
+		intermediate := make([]KeyValue, 0)
+		for _, kv := range largestCounts(counts, k) {
+			intermediate = append(intermediate, KeyValue{Key: "top", Value: kv.Key + "\t" + kv.Value})
+		}
+		return intermediate
+	}
+	topReduce := func(key string, values []string) string {
+		counts := make([]KeyValue, 0, len(values))
+		for _, v := range values {
+			key, count, _ := strings.Cut(v, "\t")
+			counts = append(counts, KeyValue{Key: key, Value: count})
+		}
+		pairs := make([]string, 0, k)
+		for _, kv := range largestCounts(counts, k) {
+			pairs = append(pairs, kv.Key+"="+kv.Value)
+		}
+		return strings.Join(pairs, " ")
+	}
+	return App{Map: topMap, Reduce: topReduce}, nil
+}
+
+// the k KeyValues with the largest integer Values, largest first and
+// ties by key; values that are not integers are skipped.
+func largestCounts(kvs []KeyValue, k int) []KeyValue {
+	type entry struct {
+		kv KeyValue
+		n  int
+	}
+	entries := make([]entry, 0, len(kvs))
+	for _, kv := range kvs {
+		if n, err := strconv.Atoi(kv.Value); err == nil {
+			entries = append(entries, entry{kv, n})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].n != entries[j].n {
+			return entries[i].n > entries[j].n
+		}
+		return entries[i].kv.Key < entries[j].kv.Key
+	})
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	largest := make([]KeyValue, len(entries))
+	for i, e := range entries {
+		largest[i] = e.kv
+	}
+	return largest
+}
@@ -0,0 +1,138 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+)
+
+// the master's persistent record of which tasks have completed, so a
+// restarted master can resume the same job instead of starting over.
+type checkpoint struct {
+	File       string
+	Size       int64 // of the input file, to notice a changed input
+	ModTime    time.Time
+	NMap       int
+	NReduce    int
+	Stages     []JobConf
+	Stage      int // the stage MapDone and ReduceDone are for
+	MapDone    []bool
+	ReduceDone []bool
+	// map tasks of the stage that were quarantined; they have no
+	// outputs. a quarantined reduce task has an empty one.
+	MapQuarantined []bool
+	// of the earlier stages, and of the completed tasks of this one
+	Counters       Counters
+	MapCounters    []Counters
+	ReduceCounters []Counters
+}
+
+func CheckpointName(fileName string) string {
+	return "mrtmp." + fileName + "-checkpoint"
+}
+
+// describe job j and its progress. mr.mu must be held.
+func (j *jobImpl) makeCheckpoint() (checkpoint, error) {
+	fi, err := os.Stat(j.file)
+	if err != nil {
+		return checkpoint{}, err
+	}
+	cp := checkpoint{File: j.file, Size: fi.Size(), ModTime: fi.ModTime(),
+		NMap: j.nMap, NReduce: j.nReduce, Stages: j.stages, Stage: j.stage}
+	cp.MapDone = append([]bool(nil), j.mapTasks.completed...)
+	cp.ReduceDone = append([]bool(nil), j.rdcTasks.completed...)
+	cp.MapQuarantined = append([]bool(nil), j.mapTasks.quarantined...)
+	cp.Counters = j.counters
+	cp.MapCounters = j.mapTasks.counters
+	cp.ReduceCounters = j.rdcTasks.counters
+	return cp, nil
+}
+
+// persist the job's progress. a failed save only costs redone work
+// after a crash, so it is reported and otherwise ignored.
+// mr.mu must be held.
+func (j *jobImpl) saveCheckpoint() {
+	cp, err := j.makeCheckpoint()
+	if err == nil {
+		err = writeFileAtomic(CheckpointName(j.name), func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(&cp)
+		})
+	}
+	if err != nil {
+		fmt.Printf("saveCheckpoint: %v\n", err)
+	}
+}
+
+// resume from a checkpoint left by an earlier master of the same job,
+// if there is one. a task only counts as done if its output files are
+// still there, and a later stage can only be resumed if the previous
+// stage's outputs are. mr.mu must be held.
+func (j *jobImpl) recoverCheckpoint() {
+	b, err := os.ReadFile(CheckpointName(j.name))
+	if err != nil {
+		return
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(b, &saved); err != nil {
+		fmt.Printf("recoverCheckpoint: ignoring %s: %v\n", CheckpointName(j.name), err)
+		return
+	}
+	cp, err := j.makeCheckpoint()
+	if err != nil || saved.File != cp.File || saved.Size != cp.Size ||
+		!saved.ModTime.Equal(cp.ModTime) || saved.NMap != cp.NMap ||
+		saved.NReduce != cp.NReduce || !reflect.DeepEqual(saved.Stages, cp.Stages) ||
+		saved.Stage < 0 || saved.Stage >= len(cp.Stages) ||
+		len(saved.MapDone) != j.stageMaps(saved.Stage) || len(saved.ReduceDone) != j.nReduce {
+		fmt.Printf("recoverCheckpoint: %s is for a different job\n", CheckpointName(j.name))
+		return
+	}
+	for r := 0; r < j.nReduce && saved.Stage > 0; r++ {
+		if !fileExists(MergeName(j.stageFile(saved.Stage-1), r)) {
+			fmt.Printf("recoverCheckpoint: outputs of stage %d are gone\n", saved.Stage-1)
+			return
+		}
+	}
+
+	j.startStage(saved.Stage)
+	if saved.Counters != nil {
+		j.counters = saved.Counters
+	}
+	file := j.stageFile(saved.Stage)
+	for m, done := range saved.MapDone {
+		if m < len(saved.MapQuarantined) && saved.MapQuarantined[m] {
+			j.mapTasks.quarantine(m)
+			continue
+		}
+		for r := 0; r < j.nReduce && done; r++ {
+			done = fileExists(ReduceName(file, m, r))
+		}
+		if done {
+			j.mapTasks.complete(m)
+			if m < len(saved.MapCounters) {
+				j.mapTasks.counters[m] = saved.MapCounters[m]
+			}
+		}
+	}
+	for r, done := range saved.ReduceDone {
+		if done && fileExists(MergeName(file, r)) {
+			j.rdcTasks.complete(r)
+			if r < len(saved.ReduceCounters) {
+				j.rdcTasks.counters[r] = saved.ReduceCounters[r]
+			}
+		}
+	}
+	fmt.Printf("recovered from checkpoint: stage %d, %d map and %d reduce jobs left\n",
+		saved.Stage, j.mapTasks.left, j.rdcTasks.left)
+}
+
+func (j *jobImpl) removeCheckpoint() {
+	os.Remove(CheckpointName(j.name))
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,84 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+)
+
+// named counts a task reports besides its output, such as records
+// seen or malformed. apps add their own through CountingMap and
+// CountingReduce; the worker adds the ones below. the master keeps the
+// counters of the attempt that completes each task and sums them up
+// per job.
+type Counters map[string]int64
+
+func (c Counters) Add(name string, delta int64) {
+	c[name] += delta
+}
+
+// counters every task reports.
+const (
+	MapInputBytes       = "map input bytes"
+	MapInputRecords     = "map input records" // lines
+	MapOutputRecords    = "map output records"
+	ReduceInputGroups   = "reduce input groups" // keys
+	ReduceInputRecords  = "reduce input records"
+	ReduceOutputRecords = "reduce output records"
+	SkippedRecords      = "skipped records"
+)
+
+// added by the master for the tasks that ran where their inputs were.
+const DataLocalTasks = "data-local tasks"
+
+// added by the master for the tasks it gave up on; see MaxAttempts.
+const QuarantinedTasks = "quarantined tasks"
+
+// add every counter of c to total.
+func (total Counters) addAll(c Counters) {
+	for name, n := range c {
+		total[name] += n
+	}
+}
+
+// the app's Map and Reduce functions, reporting to counters if the app
+// has counting versions of them.
+func (app App) withCounters(counters Counters) (func(string) []KeyValue,
+	func(string, []string) string) {
+	mapF, reduceF := app.Map, app.Reduce
+	if app.CountingMap != nil {
+		mapF = func(value string) []KeyValue {
+			return app.CountingMap(value, counters)
+		}
+	}
+	if app.CountingReduce != nil {
+		reduceF = func(key string, values []string) string {
+			return app.CountingReduce(key, values, counters)
+		}
+	}
+	return mapF, reduceF
+}
+
+// the counters of j's earlier stages and of the completed tasks of the
+// current one. mr.mu must be held.
+func (j *jobImpl) totalCounters() Counters {
+	total := make(Counters)
+	total.addAll(j.counters)
+	for _, phase := range []*phaseImpl{&j.mapTasks, &j.rdcTasks} {
+		for _, c := range phase.counters {
+			total.addAll(c)
+		}
+	}
+	return total
+}
+
+// print counters one per line, sorted by name.
+func printCounters(counters Counters) {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-24s %d\n", name, counters[name])
+	}
+}
@@ -0,0 +1,104 @@
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// intermediate files start with a header of intermediateMagic, the
+// length of the payload and its CRC-32C; the payload is the KeyValues
+// as JSON, gzip-compressed. a truncated or damaged file fails the
+// checks, so a reduce task never reads garbage.
+var intermediateMagic = []byte("mri1")
+
+const intermediateHeader = 16
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// write kvs to the intermediate file name, atomically.
+func writeIntermediate(name string, kvs []KeyValue) error {
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	enc := json.NewEncoder(zw)
+	for _, kv := range kvs {
+		if err := enc.Encode(&kv); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	header := make([]byte, intermediateHeader)
+	copy(header, intermediateMagic)
+	binary.BigEndian.PutUint64(header[4:], uint64(payload.Len()))
+	binary.BigEndian.PutUint32(header[12:], crc32.Checksum(payload.Bytes(), castagnoli))
+	return writeFileAtomic(name, func(w io.Writer) error {
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(payload.Bytes())
+		return err
+	})
+}
+
+// an intermediate file is missing or fails its checks; the map task
+// that wrote it has to run again.
+type corruptFileError struct {
+	name   string
+	reason string
+}
+
+func (e *corruptFileError) Error() string {
+	return fmt.Sprintf("intermediate file %s: %s", e.name, e.reason)
+}
+
+// read an intermediate file written by writeIntermediate.
+func readIntermediate(name string) ([]KeyValue, error) {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, &corruptFileError{name, "missing"}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(b) < intermediateHeader || !bytes.Equal(b[:4], intermediateMagic) {
+		return nil, &corruptFileError{name, "bad header"}
+	}
+	payload := b[intermediateHeader:]
+	if binary.BigEndian.Uint64(b[4:]) != uint64(len(payload)) {
+		return nil, &corruptFileError{name, "truncated"}
+	}
+	if binary.BigEndian.Uint32(b[12:]) != crc32.Checksum(payload, castagnoli) {
+		return nil, &corruptFileError{name, "checksum mismatch"}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, &corruptFileError{name, err.Error()}
+	}
+	kvs := make([]KeyValue, 0)
+	dec := json.NewDecoder(zr)
+	for {
+		var kv KeyValue
+		if err := dec.Decode(&kv); err == io.EOF {
+			return kvs, nil
+		} else if err != nil {
+			return nil, &corruptFileError{name, err.Error()}
+		}
+		kvs = append(kvs, kv)
+	}
+}
+
+// a reduce task could not read the outputs of these map tasks.
+type corruptInputError struct {
+	maps  []int
+	cause error // for the first of them
+}
+
+func (e *corruptInputError) Error() string {
+	return fmt.Sprintf("%d corrupt inputs, first %v", len(e.maps), e.cause)
+}
@@ -0,0 +1,142 @@
+package mapreduce
+
+import (
+	"strings"
+	"time"
+)
+
+// a task waits up to LocalityWait for a worker that holds its inputs
+// before it is run on any worker, as long as such a worker is alive.
+const LocalityWait = 300 * time.Millisecond
+
+// like RunWorkerWithHeartbeats, but whenever the worker registers it
+// also tells the master which files it holds locally, as listed by
+// files (e.g. input splits it was given, or intermediate files left
+// from before a restart), so that the master can run tasks where their
+// inputs are.
+func RunWorkerWithFiles(MasterAddress string, me string,
+	MapFunc func(string) []KeyValue, ReduceFunc func(string, []string) string,
+	nRPC int, files func() []string) {
+	stop := make(chan bool)
+	go heartbeat(MasterAddress, me, files, stop)
+	advertise(MasterAddress, me, files)
+	RunWorker(MasterAddress, me, MapFunc, ReduceFunc, nRPC)
+	close(stop)
+}
+
+func advertise(master string, me string, files func() []string) {
+	args, reply := &AdvertiseArgs{Worker: me, Files: files()}, AdvertiseReply{}
+	call(master, "MapReduce.Advertise", args, &reply)
+}
+
+// MapReduce.Advertise RPC handler. the files replace whatever the
+// worker held before, since it may have lost them in a restart.
+func (mr *MapReduce) Advertise(args *AdvertiseArgs, reply *AdvertiseReply) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	delete(mr.impl.local, args.Worker)
+	mr.holdFiles(args.Worker, args.Files)
+	reply.OK = true
+	return nil
+}
+
+// record that the worker at address holds files. mr.mu must be held.
+func (mr *MapReduce) holdFiles(address string, files []string) {
+	held, ok := mr.impl.local[address]
+	if !ok {
+		held = make(map[string]bool)
+		mr.impl.local[address] = held
+	}
+	for _, f := range files {
+		held[f] = true
+	}
+}
+
+// forget about the files whose names start with prefix, e.g. those of
+// a finished job. mr.mu must be held.
+func (mr *MapReduce) forgetFiles(prefix string) {
+	for _, held := range mr.impl.local {
+		for f := range held {
+			if strings.HasPrefix(f, prefix) {
+				delete(held, f)
+			}
+		}
+	}
+}
+
+// the files a task of j's current stage reads. the map inputs of a
+// later stage are written by the master, but come from the outputs of
+// the previous stage's reduce tasks.
+func (j *jobImpl) taskInputs(operation JobType, job int) []string {
+	file := j.stageFile(j.stage)
+	if operation == Map {
+		inputs := []string{MapName(file, job)}
+		if j.stage > 0 {
+			inputs = append(inputs, MergeName(j.stageFile(j.stage-1), job))
+		}
+		return inputs
+	}
+	inputs := make([]string, 0, j.stageMaps(j.stage))
+	for m := 0; m < j.stageMaps(j.stage); m++ {
+		inputs = append(inputs, ReduceName(file, m, job))
+	}
+	return inputs
+}
+
+// the files a task of j's current stage writes.
+func (j *jobImpl) taskOutputs(operation JobType, job int) []string {
+	file := j.stageFile(j.stage)
+	if operation == Map {
+		outputs := make([]string, 0, j.nReduce)
+		for r := 0; r < j.nReduce; r++ {
+			outputs = append(outputs, ReduceName(file, job, r))
+		}
+		return outputs
+	}
+	return []string{MergeName(file, job)}
+}
+
+// how many of files the worker at address holds. mr.mu must be held.
+func (mr *MapReduce) localFiles(address string, files []string) int {
+	n := 0
+	for _, f := range files {
+		if mr.impl.local[address][f] {
+			n++
+		}
+	}
+	return n
+}
+
+// the index in pending of the task to run on w, and whether w holds
+// any of its inputs: the task with the most inputs on w, or failing
+// that the oldest one that has waited LocalityWait or whose inputs are
+// on no live worker. -1 if w should be turned down, which is known as
+// delay scheduling. mr.mu must be held.
+func (mr *MapReduce) pickTask(j *jobImpl, operation JobType, pending []int,
+	since map[int]time.Time, w *WorkerInfo) (int, bool) {
+	best, most := -1, 0
+	for i, job := range pending {
+		if n := mr.localFiles(w.address, j.taskInputs(operation, job)); n > most {
+			best, most = i, n
+		}
+	}
+	if best != -1 {
+		return best, true
+	}
+	for i, job := range pending {
+		if time.Since(since[job]) >= LocalityWait || !mr.heldByLiveWorker(j.taskInputs(operation, job)) {
+			return i, false
+		}
+	}
+	return -1, false
+}
+
+// mr.mu must be held.
+func (mr *MapReduce) heldByLiveWorker(files []string) bool {
+	for address, w := range mr.Workers {
+		if w.impl.alive && mr.localFiles(address, files) > 0 {
+			return true
+		}
+	}
+	return false
+}
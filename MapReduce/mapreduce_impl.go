@@ -1,15 +1,139 @@
 package mapreduce
 
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
 // any additional state that you want to add to type MapReduce
 type MapReduceImpl struct {
-	mapJobs      []int
-	mapOccupied  []bool
-	mapCompleted []bool
-	mapLeft      int
-	rdcJobs      []int
-	rdcOccupied  []bool
-	rdcCompleted []bool
-	rdcLeft      int
+	job      *jobImpl         // the job MakeMapReduce* was given; nil for a job service
+	jobs     map[int]*jobImpl // every job, by id
+	nextJob  int
+	policy   string                     // how the broker shares workers between jobs
+	free     chan *WorkerInfo           // workers handed back to the broker
+	wants    chan *jobImpl              // jobs asking the broker for a worker
+	slots    chan bool                  // admission of submitted jobs; see MaxActiveJobs
+	finished chan bool                  // closed once the master is done
+	local    map[string]map[string]bool // the files each worker holds, by address
+}
+
+// the state of one MapReduce job. protected by mr.mu unless noted.
+type jobImpl struct {
+	id       int
+	file     string // input file
+	name     string // the job's own files are named after it
+	nMap     int
+	nReduce  int
+	priority int
+	stages   []JobConf // the job's pipeline; see MakeMapReducePipeline
+	stage    int       // the stage being run
+	points   []string  // the stage's split points, for RangePartition
+	phase    string    // reported by Status
+	mapTasks phaseImpl
+	rdcTasks phaseImpl
+	counters Counters         // of the stages before the current one
+	lent     int              // workers granted by the broker and not yet given back
+	over     bool             // the job wants no more workers
+	idle     chan *WorkerInfo // granted workers; never holds more than one
+	wanting  bool             // a worker has been asked for; owned by the job's scheduler
+	output   string           // result file of a submitted job, once done
+	err      error
+}
+
+func makeJobImpl(id int, file string, name string, nmap int, nreduce int,
+	stages []JobConf, priority int) *jobImpl {
+	return &jobImpl{id: id, file: file, name: name, nMap: nmap, nReduce: nreduce,
+		priority: priority, stages: stages, phase: "Starting", counters: make(Counters),
+		mapTasks: makePhaseImpl(nmap), rdcTasks: makePhaseImpl(nreduce),
+		idle: make(chan *WorkerInfo, 1)}
+}
+
+// bookkeeping for the tasks of one phase, indexed by task number.
+// protected by mr.mu.
+type phaseImpl struct {
+	running  []int // attempts currently in flight
+	attempts []int
+	failures []int
+	lost     []int           // attempts lost with their worker or the RPC to it
+	suspects []map[int64]int // failed attempts that reported each bad record
+	skip     [][]int64       // bad records reported by two failed attempts
+	// likewise for the keys of a reduce task, which are named by the key
+	// itself: their positions change when a map task runs again.
+	keySuspects []map[string]int
+	skipKeys    [][]string
+	counters    []Counters // of the attempt that completed each task
+	completed   []bool
+	// given up on, and left out of the job's output; also completed
+	quarantined []bool
+	started     []time.Time // when the task's first attempt was assigned
+	finished    []time.Time
+	backedUp    []bool          // a speculative backup attempt was launched
+	durations   []time.Duration // of completed tasks, for the phase median
+	left        int
+}
+
+func makePhaseImpl(ntasks int) phaseImpl {
+	return phaseImpl{
+		running:     make([]int, ntasks),
+		attempts:    make([]int, ntasks),
+		failures:    make([]int, ntasks),
+		lost:        make([]int, ntasks),
+		suspects:    make([]map[int64]int, ntasks),
+		skip:        make([][]int64, ntasks),
+		keySuspects: make([]map[string]int, ntasks),
+		skipKeys:    make([][]string, ntasks),
+		counters:    make([]Counters, ntasks),
+		completed:   make([]bool, ntasks),
+		quarantined: make([]bool, ntasks),
+		started:     make([]time.Time, ntasks),
+		finished:    make([]time.Time, ntasks),
+		backedUp:    make([]bool, ntasks),
+		durations:   make([]time.Duration, 0, ntasks),
+		left:        ntasks,
+	}
+}
+
+// mark task job completed; returns false if it already was.
+func (phase *phaseImpl) complete(job int) bool {
+	if phase.completed[job] {
+		return false
+	}
+	phase.completed[job] = true
+	phase.left--
+	return true
+}
+
+// mark task job quarantined, which also completes it.
+func (phase *phaseImpl) quarantine(job int) {
+	phase.complete(job)
+	phase.quarantined[job] = true
+	phase.counters[job] = Counters{QuarantinedTasks: 1}
+}
+
+// the quarantined tasks, in order.
+func (phase *phaseImpl) quarantinedTasks() []int {
+	tasks := make([]int, 0)
+	for job, q := range phase.quarantined {
+		if q {
+			tasks = append(tasks, job)
+		}
+	}
+	return tasks
+}
+
+// mark task job as not completed after all, e.g. because its outputs
+// were lost.
+func (phase *phaseImpl) reopen(job int) {
+	if !phase.completed[job] {
+		return
+	}
+	phase.completed[job] = false
+	phase.quarantined[job] = false
+	phase.left++
+	phase.backedUp[job] = false
+	phase.counters[job] = nil
 }
 
 // additional initialization of mr.* state beyond that in InitMapReduce
@@ -17,29 +141,63 @@ func (mr *MapReduce) InitMapReduceImpl(nmap int, nreduce int,
 	file string, master string) {
 
 	mr.Workers = make(map[string]*WorkerInfo)
+	mr.impl = MapReduceImpl{jobs: make(map[int]*jobImpl), nextJob: 1,
+		policy:   FairShare,
+		free:     make(chan *WorkerInfo),
+		wants:    make(chan *jobImpl),
+		slots:    make(chan bool, MaxActiveJobs),
+		finished: make(chan bool),
+		local:    make(map[string]map[string]bool)}
+	mr.impl.job = makeJobImpl(0, file, file, nmap, nreduce, []JobConf{{}}, 1)
+	mr.impl.jobs[0] = mr.impl.job
+}
 
-	// put them into fields
-	mJobs := make([]int, mr.nMap)
-	mOccupied := make([]bool, mr.nMap)
-	mCompleted := make([]bool, mr.nMap)
-	for i := 0; i < mr.nMap; i++ {
-		mJobs[i] = i
-		mOccupied[i] = false
-		mCompleted[i] = false
-	}
+// like MakeMapReduce, but the workers run the registered app
+// named in conf (see RegisterApp) instead of their own Map/Reduce
+// functions.
+func MakeMapReduceJob(nmap int, nreduce int, file string, master string,
+	conf JobConf) *MapReduce {
+	return MakeMapReducePipeline(nmap, nreduce, file, master, []JobConf{conf})
+}
 
-	rJobs := make([]int, mr.nReduce)
-	rOccupied := make([]bool, mr.nReduce)
-	rCompleted := make([]bool, mr.nMap)
-	for i := 0; i < mr.nReduce; i++ {
-		rJobs[i] = i
-		rOccupied[i] = false
-		rCompleted[i] = false
+// like MakeMapReduceJob, but runs a chain of stages on the same
+// workers: the nreduce outputs of each stage, as "key\tvalue" lines,
+// are the map inputs of the next, and the last stage's outputs are the
+// job's result.
+func MakeMapReducePipeline(nmap int, nreduce int, file string, master string,
+	stages []JobConf) *MapReduce {
+	if err := checkStages(stages); err != nil {
+		log.Fatal("MakeMapReducePipeline: ", err)
 	}
+	mr := InitMapReduce(nmap, nreduce, file, master)
+	mr.impl.job.stages = stages
+	mr.StartRegistrationServer()
+	go mr.Run()
+	return mr
+}
 
-	mr.impl = MapReduceImpl{mapJobs: mJobs, rdcJobs: rJobs,
-		mapOccupied: mOccupied, rdcOccupied: rOccupied,
-		mapCompleted: mCompleted, rdcCompleted: rCompleted,
-		mapLeft: mr.nMap, rdcLeft: mr.nReduce}
-
+// make sure every stage names a usable app and options it supports.
+func checkStages(stages []JobConf) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("no stages")
+	}
+	for _, conf := range stages {
+		app := App{}
+		if conf.App != "" {
+			var err error
+			if app, err = LookupApp(conf.App, conf.Param); err != nil {
+				return err
+			}
+		}
+		if conf.Combine && app.Combine == nil {
+			return fmt.Errorf("app %q has no combiner", conf.App)
+		}
+		if err := checkPartitioner(conf, app); err != nil {
+			return err
+		}
+		if conf.Mapper != "" && conf.Partitioner == RangePartition {
+			return fmt.Errorf("range partitioning cannot sample a streaming mapper")
+		}
+	}
+	return nil
 }
@@ -2,137 +2,560 @@ package mapreduce
 
 import (
 	"fmt"
+	"log"
+	"sort"
 	"time"
 )
 
 // any additional state that you want to add to type WorkerInfo
+// protected by mr.mu.
 type WorkerInfoImpl struct {
-	free bool
+	alive         bool // false once evicted
+	heartbeats    bool // the worker heartbeats; otherwise only RPC errors tell it is gone
+	lastHeartbeat time.Time
+	current       *taskAttempt // in flight on the worker, if any
+}
+
+// a worker that heartbeats is evicted after HeartbeatTimeout without one.
+const (
+	HeartbeatInterval = 100 * time.Millisecond
+	HeartbeatTimeout  = 5 * HeartbeatInterval
+)
+
+// one attempt of a task; its outcome is reported on done exactly once,
+// either by the attempt itself or by evictWorker.
+type taskAttempt struct {
+	j         *jobImpl
+	stage     int
+	operation JobType
+	job       int
+	done      chan taskResult
+}
+
+// a task still running after BackupFactor times the phase's median task
+// time (and at least BackupMinAge) gets a speculative backup attempt
+// once every task of the phase has been handed out. stragglers are
+// looked for every BackupCheckInterval.
+const (
+	BackupFactor        = 2
+	BackupMinAge        = 500 * time.Millisecond
+	BackupCheckInterval = 100 * time.Millisecond
+)
+
+// the outcome of one attempt of a task, sent on the phase's
+// completion channel.
+type taskResult struct {
+	worker   *WorkerInfo
+	job      int
+	ok       bool
+	lost     bool     // with its worker or the RPC to it; the task itself did not fail
+	bad      []int64  // records the attempt failed on; see DoTaskReply
+	badKeys  []string // likewise for a reduce task
+	counters Counters
+	local    bool  // the attempt ran where its inputs were
+	corrupt  []int // map tasks whose outputs the attempt could not read
+}
+
+// runPhase stopped because reduce tasks found the outputs of these
+// map tasks missing or corrupt.
+type lostOutputsError struct {
+	maps []int
+}
+
+func (e *lostOutputsError) Error() string {
+	return fmt.Sprintf("outputs of map tasks %v lost", e.maps)
+}
+
+// a task is quarantined after this many failed attempts unless its
+// JobConf says otherwise.
+const DefaultMaxAttempts = 4
+
+// a task is quarantined too once LostAttemptsFactor times its
+// MaxAttempts attempts are lost with their worker: user code that
+// kills the worker (log.Fatal, os.Exit, running out of memory) leaves
+// no worker to report the failure. the margin is for workers that die
+// of other causes while running a healthy task.
+const LostAttemptsFactor = 2
+
+// failed attempts after which a task of j's current stage is
+// quarantined.
+func (j *jobImpl) maxAttempts() int {
+	if max := j.stages[j.stage].MaxAttempts; max > 0 {
+		return max
+	}
+	return DefaultMaxAttempts
+}
+
+// lost attempts after which a task of j's current stage is
+// quarantined.
+func (j *jobImpl) maxLost() int {
+	return LostAttemptsFactor * j.maxAttempts()
 }
 
 // run the MapReduce job across all the workers
 func (mr *MapReduce) RunMasterImpl() {
+	go mr.manageWorkers()
+	go mr.broker()
+	if err := mr.runJob(mr.impl.job); err != nil {
+		log.Fatal("RunMasterImpl: ", err)
+	}
+	mr.mu.Lock()
+	mr.impl.job.phase = "Done"
+	mr.mu.Unlock()
+	close(mr.impl.finished)
+}
 
-	fmt.Printf("start mapping, %d jobs in total\n", mr.nMap)
-	// assign workers to map
-	for mr.impl.mapLeft > 0 {
-		if len(mr.registerChannel) != 0 {
-			mr.UpdateWorker()
-		}
-		mr.UpdateCompleted()
+// run every stage of j on workers granted by the broker, resuming from
+// j's checkpoint if it has one. fails if the master shuts down first.
+func (mr *MapReduce) runJob(j *jobImpl) error {
+	mr.mu.Lock()
+	j.recoverCheckpoint()
+	first := j.stage
+	mr.mu.Unlock()
+	defer mr.endJob(j)
 
-		for _, w := range mr.Workers {
-			if w.impl.free {
+	for stage := first; stage < len(j.stages); stage++ {
+		if stage != first {
+			mr.mu.Lock()
+			j.startStage(stage)
+			mr.mu.Unlock()
+		}
+		if stage > 0 {
+			fmt.Printf("start stage %d\n", stage)
+			if err := j.prepareStage(stage); err != nil {
+				return err
+			}
+		}
+		if err := mr.sampleSplitPoints(j, stage); err != nil {
+			return err
+		}
+		nmap := j.stageMaps(stage)
+		for {
+			fmt.Printf("start mapping, %d jobs in total\n", nmap)
+			if err := mr.runPhase(j, Map, &j.mapTasks, j.nReduce); err != nil {
+				return err
+			}
 
-				allocate := -1
-				for _, job := range mr.impl.mapJobs {
-					if !mr.impl.mapOccupied[job] {
-						allocate = job
-						break
-					}
+			fmt.Printf("start reducing, %d jobs in total\n", j.nReduce)
+			err := mr.runPhase(j, Reduce, &j.rdcTasks, nmap)
+			lost, ok := err.(*lostOutputsError)
+			if !ok {
+				if err != nil {
+					return err
 				}
-				if allocate == -1 {
-					break
+				break
+			}
+			// run the map tasks that lost their outputs again, then
+			// the reduce tasks that are left. a lost output counts as a
+			// failure of the map task, so one whose outputs never come
+			// out readable is quarantined in the end.
+			mr.mu.Lock()
+			for _, m := range lost.maps {
+				j.mapTasks.failures[m]++
+				if j.mapTasks.failures[m] >= j.maxAttempts() {
+					mr.quarantine(j, Map, &j.mapTasks, m)
+					continue
 				}
-				 
-				w.impl.free = false
-				mr.impl.mapOccupied[allocate] = true
-				fmt.Printf("Job  %d assigned to %s\n", allocate, w.address)
-				//mr.mu.Unlock()
-				go func(wk *WorkerInfo) {
-					var reply DoJobReply
-					mr.DoJob(wk, Map, allocate, mr.nReduce, &reply)
-					//mr.mu.Lock()
-					if reply.OK {
-						mr.impl.mapCompleted[allocate] = true
-						wk.impl.free = true
-					} else {
-						mr.impl.mapOccupied[allocate] = false
-						time.Sleep(50 * time.Millisecond)
-						wk.impl.free = true
-					}
-					//mr.mu.Unlock()
-				}(w)
-			}
-		}
-	}
-
-	fmt.Printf("start reducing, %d jobs in total", mr.nReduce)
-	//assign workers to reduce
-	for mr.impl.rdcLeft > 0 {
-		if len(mr.registerChannel) != 0 {
-			mr.UpdateWorker()
-		}
-		mr.UpdateCompleted()
-		for _, w := range mr.Workers {
-			if w.impl.free {
-				allocate := -1
-				for _, job := range mr.impl.rdcJobs {
-					if !mr.impl.rdcOccupied[job] {
-						allocate = job
-						break
-					}
+				fmt.Printf("Job  %d lost its outputs, mapping again\n", m)
+				j.mapTasks.reopen(m)
+			}
+			mr.mu.Unlock()
+		}
+	}
+	if err := j.finishPipeline(); err != nil {
+		return err
+	}
+	j.removeCheckpoint()
+	mr.mu.Lock()
+	counters := j.totalCounters()
+	mr.mu.Unlock()
+	fmt.Printf("counters:\n")
+	printCounters(counters)
+	return nil
+}
+
+// hand workers to the broker as they register and evict the ones
+// that stop heartbeating, for as long as the master runs.
+func (mr *MapReduce) manageWorkers() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case address := <-mr.registerChannel:
+			if w := mr.UpdateWorker(address); w != nil {
+				go mr.returnWorker(w)
+			}
+		case <-ticker.C:
+			mr.mu.Lock()
+			for _, w := range mr.Workers {
+				if w.impl.heartbeats && time.Since(w.impl.lastHeartbeat) > HeartbeatTimeout {
+					mr.evictWorker(w)
 				}
-				if allocate == -1 {
-					break
+			}
+			mr.mu.Unlock()
+		case <-mr.impl.finished:
+			return
+		}
+	}
+}
+
+// forget about a failed worker, writing off the task attempt it was
+// running so the task gets reassigned. it can register again once it
+// recovers. mr.mu must be held.
+func (mr *MapReduce) evictWorker(w *WorkerInfo) {
+	if !w.impl.alive {
+		return
+	}
+	fmt.Printf("worker %s evicted\n", w.address)
+	w.impl.alive = false
+	if mr.Workers[w.address] == w {
+		delete(mr.Workers, w.address)
+	}
+	if att := w.impl.current; att != nil {
+		w.impl.current = nil
+		att.done <- taskResult{worker: w, job: att.job, ok: false, lost: true}
+	}
+}
+
+// MapReduce.Heartbeat RPC handler.
+func (mr *MapReduce) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	w, ok := mr.Workers[args.Worker]
+	if !ok || !w.impl.alive {
+		reply.OK = false
+		return nil
+	}
+	w.impl.heartbeats = true
+	w.impl.lastHeartbeat = time.Now()
+	reply.OK = true
+	return nil
+}
+
+// give w, granted to j, back to the broker unless it has been evicted.
+func (mr *MapReduce) release(j *jobImpl, w *WorkerInfo) {
+	mr.mu.Lock()
+	j.lent--
+	alive := w.impl.alive
+	mr.mu.Unlock()
+	if alive {
+		mr.returnWorker(w)
+	}
+}
+
+// put w in the broker's pool of free workers; blocks until the broker
+// takes it or the master is done.
+func (mr *MapReduce) returnWorker(w *WorkerInfo) {
+	select {
+	case mr.impl.free <- w:
+	case <-mr.impl.finished:
+	}
+}
+
+// schedule the tasks of one phase of j until all of them have
+// completed or been quarantined; fails if the master shuts down first,
+// and stops with a *lostOutputsError once the attempts in flight are
+// over if reduce tasks could not read their inputs. the loop takes
+// tasks off the task queue and asks the broker for workers to run them
+// on, preferring the task whose inputs are local to each worker (see
+// pickTask); it handles completions and backs up stragglers meanwhile,
+// and only ever blocks in select.
+func (mr *MapReduce) runPhase(j *jobImpl, operation JobType, phase *phaseImpl,
+	otherPhase int) error {
+	// a task has at most two entries queued or attempts in flight at
+	// once (the original and one backup), so neither channel ever fills
+	// up, even with attempts finishing after the phase is over.
+	ntasks := len(phase.completed)
+	queue := make(chan int, 2*ntasks)
+	done := make(chan taskResult, 2*ntasks)
+	mr.mu.Lock()
+	j.phase = string(operation)
+	for job, completed := range phase.completed {
+		if !completed {
+			queue <- job
+		}
+	}
+	mr.mu.Unlock()
+
+	ticker := time.NewTicker(BackupCheckInterval)
+	defer ticker.Stop()
+	pending := make([]int, 0, ntasks) // off the queue, oldest first
+	since := make(map[int]time.Time)  // when each pending task was taken off
+	declined := false                 // a worker was turned down since the last tick
+	lost := make(map[int]bool)        // map tasks to run again before going on
+	for {
+		mr.mu.Lock()
+		left, running := phase.left, 0
+		for _, n := range phase.running {
+			running += n
+		}
+		mr.mu.Unlock()
+		if left == 0 {
+			return nil
+		}
+		if len(lost) > 0 && running == 0 {
+			maps := make([]int, 0, len(lost))
+			for m := range lost {
+				maps = append(maps, m)
+			}
+			sort.Ints(maps)
+			return &lostOutputsError{maps}
+		}
+
+		// with tasks pending, wait for a worker too. a request to the
+		// broker stays outstanding until it is granted, even across
+		// phases.
+		var idle chan *WorkerInfo
+		if len(pending) > 0 && !declined && len(lost) == 0 {
+			if !j.wanting {
+				mr.askForWorker(j)
+				j.wanting = true
+			}
+			idle = j.idle
+		}
+		select {
+		case job := <-queue:
+			mr.mu.Lock()
+			if !phase.completed[job] {
+				pending = append(pending, job)
+				since[job] = time.Now()
+			}
+			mr.mu.Unlock()
+		case w := <-idle:
+			j.wanting = false
+			mr.mu.Lock()
+			alive := w.impl.alive
+			kept := pending[:0]
+			for _, job := range pending {
+				if !phase.completed[job] {
+					kept = append(kept, job)
 				}
+			}
+			pending = kept
+			i, local := -1, false
+			if alive {
+				i, local = mr.pickTask(j, operation, pending, since, w)
+			}
+			mr.mu.Unlock()
+			if i == -1 {
+				// evicted while granted, no tasks left, or none worth
+				// running on w yet; keep the tasks for the next worker.
+				declined = alive && len(pending) > 0
+				go mr.release(j, w)
+				continue
+			}
+			job := pending[i]
+			pending = append(pending[:i], pending[i+1:]...)
+			delete(since, job)
+			mr.startTask(j, w, operation, phase, job, otherPhase, local, done)
+		case res := <-done:
+			if len(res.corrupt) > 0 {
+				// not the task's own failure but theirs; it runs again
+				// once the map tasks it depends on have.
 				mr.mu.Lock()
-				w.impl.free = false
-				mr.impl.rdcOccupied[allocate] = true
+				phase.running[res.job]--
 				mr.mu.Unlock()
-
-				go func(wk *WorkerInfo) {
-					var reply DoJobReply
-					mr.DoJob(wk, Reduce, allocate, mr.nMap, &reply)
-					//time.Sleep(time.Duration(3) * time.Second)
-					//mr.mu.Lock()
-					if reply.OK {
-						mr.impl.rdcCompleted[allocate] = true
-						wk.impl.free = true
-					} else {
-						mr.impl.rdcOccupied[allocate] = false
-						time.Sleep(50 * time.Millisecond)
-						wk.impl.free = true
-					}
-					//mr.mu.Unlock()
-				}(w)
+				for _, m := range res.corrupt {
+					lost[m] = true
+				}
+				continue
 			}
+			if err := mr.finishTask(j, operation, phase, res, queue); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			declined = false
+			mr.backupStragglers(phase, queue)
+		case <-mr.impl.finished:
+			return fmt.Errorf("master shut down")
 		}
 	}
-
 }
 
-func (mr *MapReduce) DoJob(w *WorkerInfo, operation JobType, job int, otherPhase int, reply *DoJobReply) {
-	DPrintf("DoWork %s %s\n", operation, w.address)
-	args := &DoJobArgs{File: mr.file, Operation: operation, JobNumber: job, NumOtherPhase: otherPhase}
-	ok := call(w.address, "Worker.DoJob", args, &reply)
-	if !ok {
-		fmt.Printf("DoWork: RPC %s DoJob %s error\n", w.address, operation)
+// run one attempt of task job of j on w in the background, reporting
+// the outcome on done and then handing w back to the broker. a worker
+// that does not heartbeat is evicted if the RPC to it fails. local
+// tells whether w holds the task's inputs.
+func (mr *MapReduce) startTask(j *jobImpl, w *WorkerInfo, operation JobType,
+	phase *phaseImpl, job int, otherPhase int, local bool, done chan taskResult) {
+	where := ""
+	if local {
+		where = " (local)"
+	}
+	mr.mu.Lock()
+	if phase.running[job] == 0 {
+		phase.started[job] = time.Now()
+		fmt.Printf("Job  %d assigned to %s%s\n", job, w.address, where)
+	} else {
+		fmt.Printf("Job  %d backed up on %s%s\n", job, w.address, where)
+	}
+	phase.running[job]++
+	phase.attempts[job]++
+	att := &taskAttempt{j: j, stage: j.stage, operation: operation, job: job, done: done}
+	w.impl.current = att
+	args := &DoTaskArgs{DoJobArgs: DoJobArgs{File: j.stageFile(j.stage),
+		Operation: operation, JobNumber: job, NumOtherPhase: otherPhase},
+		Conf: j.stages[j.stage], SplitPoints: j.points,
+		Skip:     append([]int64(nil), phase.skip[job]...),
+		SkipKeys: append([]string(nil), phase.skipKeys[job]...)}
+	if operation == Reduce {
+		args.SkipMaps = j.mapTasks.quarantinedTasks()
 	}
+	mr.mu.Unlock()
 
+	go func() {
+		var reply DoTaskReply
+		ok := mr.DoJob(w, args, &reply)
+		if !reply.OK {
+			time.Sleep(50 * time.Millisecond)
+		}
+		mr.mu.Lock()
+		if w.impl.current == att {
+			w.impl.current = nil
+			done <- taskResult{worker: w, job: job, ok: reply.OK, lost: !ok, bad: reply.BadRecords,
+				badKeys: reply.BadKeys, counters: reply.Counters, local: local, corrupt: reply.CorruptMaps}
+		}
+		if !ok && !w.impl.heartbeats {
+			mr.evictWorker(w)
+		}
+		mr.mu.Unlock()
+		mr.release(j, w)
+	}()
 }
 
-func (mr *MapReduce) UpdateWorker() {
+// record the outcome of an attempt; the first attempt to succeed
+// completes the task, later ones are ignored. a task whose attempts
+// have all failed or been lost goes back on the queue, unless the task
+// itself has failed MaxAttempts times, or lost maxLost attempts: then
+// it is quarantined. lost attempts are counted apart from failures the
+// worker reports, so that a flaky or evicted worker takes more of them
+// to use up a task's attempts.
+func (mr *MapReduce) finishTask(j *jobImpl, operation JobType, phase *phaseImpl,
+	res taskResult, queue chan int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	phase.running[res.job]--
+	if res.ok {
+		if phase.complete(res.job) {
+			if res.local {
+				if res.counters == nil {
+					res.counters = make(Counters)
+				}
+				res.counters.Add(DataLocalTasks, 1)
+			}
+			phase.counters[res.job] = res.counters
+			mr.holdFiles(res.worker.address, j.taskOutputs(operation, res.job))
+			phase.finished[res.job] = time.Now()
+			phase.durations = append(phase.durations, time.Since(phase.started[res.job]))
+			if n := len(phase.skip[res.job]) + len(phase.skipKeys[res.job]); n > 0 {
+				fmt.Printf("Job  %d skipped %d bad records\n", res.job, n)
+			}
+			j.saveCheckpoint()
+		}
+		return nil
+	}
 
-	args := <-mr.registerChannel
-	newInfo := WorkerInfo{address: args, impl: WorkerInfoImpl{free: true}}
-	mr.Workers[args] = &newInfo
-	fmt.Printf("one worker updated\n")
+	if res.lost {
+		phase.lost[res.job]++
+	} else {
+		phase.failures[res.job]++
+	}
+	for _, off := range res.bad {
+		if phase.suspects[res.job] == nil {
+			phase.suspects[res.job] = make(map[int64]int)
+		}
+		phase.suspects[res.job][off]++
+		if phase.suspects[res.job][off] == 2 {
+			phase.skip[res.job] = append(phase.skip[res.job], off)
+		}
+	}
+	for _, key := range res.badKeys {
+		if phase.keySuspects[res.job] == nil {
+			phase.keySuspects[res.job] = make(map[string]int)
+		}
+		phase.keySuspects[res.job][key]++
+		if phase.keySuspects[res.job][key] == 2 {
+			phase.skipKeys[res.job] = append(phase.skipKeys[res.job], key)
+		}
+	}
+	if phase.completed[res.job] || phase.running[res.job] > 0 {
+		return nil
+	}
+	if phase.failures[res.job] >= j.maxAttempts() || phase.lost[res.job] >= j.maxLost() {
+		return mr.quarantine(j, operation, phase, res.job)
+	}
+	queue <- res.job
+	return nil
+}
+
+// give up on task job of j after it has failed too often, and leave its
+// input out of the job's output instead: reduce tasks skip the outputs
+// of a quarantined map task, and a quarantined reduce task's output is
+// empty. the task shows up as such in Status and in the job's
+// QuarantinedTasks counter. mr.mu must be held.
+func (mr *MapReduce) quarantine(j *jobImpl, operation JobType, phase *phaseImpl, job int) error {
+	fmt.Printf("Job  %d quarantined after %d failures and %d lost attempts\n",
+		job, phase.failures[job], phase.lost[job])
+	if operation == Reduce {
+		if err := writeKeyValues(MergeName(j.stageFile(j.stage), job), nil); err != nil {
+			return err
+		}
+	}
+	phase.quarantine(job)
+	j.saveCheckpoint()
+	return nil
 }
 
-func (mr *MapReduce) UpdateCompleted() {
-	mcomplete := 0
-	rcomplete := 0
-	for i := 0; i < mr.nMap; i++ {
-		if mr.impl.mapCompleted[i] {
-			mcomplete += 1
+// once every remaining task is running, queue a backup attempt for
+// each one that has run far longer than the phase's median.
+func (mr *MapReduce) backupStragglers(phase *phaseImpl, queue chan int) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if len(phase.durations) == 0 {
+		return
+	}
+	for job, completed := range phase.completed {
+		if !completed && phase.running[job] == 0 {
+			return
 		}
 	}
-	for i := 0; i < mr.nReduce; i++ {
-		if mr.impl.rdcCompleted[i] {
-			rcomplete += 1
+	sorted := append([]time.Duration(nil), phase.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	threshold := BackupFactor * sorted[len(sorted)/2]
+	if threshold < BackupMinAge {
+		threshold = BackupMinAge
+	}
+	for job, completed := range phase.completed {
+		if !completed && !phase.backedUp[job] &&
+			time.Since(phase.started[job]) > threshold {
+			phase.backedUp[job] = true
+			queue <- job
 		}
 	}
-	mr.impl.mapLeft = mr.nMap - mcomplete
-	mr.impl.rdcLeft = mr.nReduce - rcomplete
+}
+
+// returns false if the RPC to w failed.
+func (mr *MapReduce) DoJob(w *WorkerInfo, args *DoTaskArgs, reply *DoTaskReply) bool {
+	DPrintf("DoWork %s %s\n", args.Operation, w.address)
+	ok := call(w.address, "Worker.DoTask", args, &reply)
+	if !ok {
+		fmt.Printf("DoWork: RPC %s DoJob %s error\n", w.address, args.Operation)
+	}
+	return ok
+}
+
+// record a newly registered worker; returns nil if it is already
+// registered and alive, e.g. when it re-registers after a lost
+// heartbeat reply.
+func (mr *MapReduce) UpdateWorker(address string) *WorkerInfo {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if w, exist := mr.Workers[address]; exist && w.impl.alive {
+		return nil
+	}
+	newInfo := WorkerInfo{address: address,
+		impl: WorkerInfoImpl{alive: true, lastHeartbeat: time.Now()}}
+	mr.Workers[address] = &newInfo
+	fmt.Printf("one worker updated\n")
+	return &newInfo
 }
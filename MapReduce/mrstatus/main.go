@@ -0,0 +1,93 @@
+// mrstatus polls a running MapReduce master and prints its phase,
+// tasks and workers.
+//
+//	mrstatus [-interval 1s] [-once] [-job n] master-address
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"proj1/mapreduce"
+)
+
+func main() {
+	interval := flag.Duration("interval", time.Second, "time between polls")
+	once := flag.Bool("once", false, "print the status once and exit")
+	job := flag.Int("job", 0, "job to report on, for a master running submitted jobs")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: mrstatus [-interval 1s] [-once] [-job n] master-address\n")
+		os.Exit(1)
+	}
+	master := flag.Arg(0)
+
+	for {
+		status, ok := mapreduce.GetStatus(master, *job)
+		if !ok {
+			fmt.Printf("%s: master unreachable or no job %d\n", time.Now().Format(time.TimeOnly), *job)
+		} else {
+			printStatus(&status)
+		}
+		if *once || status.Phase == "Done" || status.Phase == "Failed" {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func printStatus(status *mapreduce.StatusReply) {
+	fmt.Printf("%s: %s, stage %d/%d, phase %s\n", time.Now().Format(time.TimeOnly),
+		status.File, status.Stage+1, status.Stages, status.Phase)
+	printTasks("map", status.MapTasks)
+	printTasks("reduce", status.ReduceTasks)
+	fmt.Printf("  %d workers\n", len(status.Workers))
+	for _, w := range status.Workers {
+		health := "no heartbeats"
+		if w.Heartbeats {
+			health = "last heartbeat " + w.SinceHeartbeat.Round(time.Millisecond).String() + " ago"
+		}
+		task := w.Task
+		if task == "" {
+			task = "idle"
+		}
+		fmt.Printf("    %-30s %-12s %s\n", w.Address, task, health)
+	}
+	if len(status.Counters) > 0 {
+		printCounters(status.Counters)
+	}
+}
+
+func printTasks(name string, tasks []mapreduce.TaskStatus) {
+	done := 0
+	for _, t := range tasks {
+		if t.State == mapreduce.TaskDone {
+			done++
+		}
+	}
+	fmt.Printf("  %s: %d/%d done\n", name, done, len(tasks))
+	for _, t := range tasks {
+		if t.State == mapreduce.TaskDone && t.Attempts <= 1 {
+			continue
+		}
+		fmt.Printf("    %-6d %-12s attempts %-3d failures %-3d lost %-3d skipped %-3d %-10s %s\n",
+			t.Job, t.State, t.Attempts, t.Failures, t.Lost, t.Skipped,
+			t.Elapsed.Round(time.Millisecond), strings.Join(t.Workers, ","))
+	}
+}
+
+func printCounters(counters mapreduce.Counters) {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("  counters\n")
+	for _, name := range names {
+		fmt.Printf("    %-24s %d\n", name, counters[name])
+	}
+}
@@ -0,0 +1,109 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// values of JobConf.Partitioner. RangePartition assigns keys by ranges
+// sampled from the input, so that the reduce outputs, taken in order,
+// are globally sorted.
+const (
+	HashPartition  = ""      // by hash of the key
+	RangePartition = "range" // by sampled key ranges
+	AppPartition   = "app"   // by the app's Partition function
+)
+
+// how much of each map input the master reads to pick split points
+// for RangePartition.
+const SampleBytes = 64 * 1024
+
+func checkPartitioner(conf JobConf, app App) error {
+	switch conf.Partitioner {
+	case HashPartition:
+	case RangePartition:
+		if conf.App == "" {
+			return fmt.Errorf("range partitioning needs a registered app")
+		}
+	case AppPartition:
+		if app.Partition == nil {
+			return fmt.Errorf("app %q has no partitioner", conf.App)
+		}
+	default:
+		return fmt.Errorf("unknown partitioner %q", conf.Partitioner)
+	}
+	return nil
+}
+
+// the partition function a map task uses.
+func makePartition(partitioner string, app App, points []string) func(string, int) int {
+	switch partitioner {
+	case RangePartition:
+		// reduce task r gets the keys in (points[r-1], points[r]].
+		return func(key string, nreduce int) int {
+			return sort.SearchStrings(points, key)
+		}
+	case AppPartition:
+		return app.Partition
+	}
+	return func(key string, nreduce int) int {
+		return int(ihash(key) % uint32(nreduce))
+	}
+}
+
+// for a stage with RangePartition, run the app's Map over the start
+// of each map input and pick nReduce-1 split points that divide the
+// sampled keys evenly. the sample only depends on the inputs, so a
+// master resuming from a checkpoint picks the same points.
+func (mr *MapReduce) sampleSplitPoints(j *jobImpl, stage int) error {
+	conf := j.stages[stage]
+	var points []string
+	if conf.Partitioner == RangePartition {
+		app, err := LookupApp(conf.App, conf.Param)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0)
+		for m := 0; m < j.stageMaps(stage); m++ {
+			sample, err := readSample(MapName(j.stageFile(stage), m))
+			if err != nil {
+				return err
+			}
+			for _, kv := range app.Map(sample) {
+				keys = append(keys, kv.Key)
+			}
+		}
+		sort.Strings(keys)
+		points = make([]string, 0, j.nReduce-1)
+		for r := 1; r < j.nReduce && len(keys) > 0; r++ {
+			points = append(points, keys[r*len(keys)/j.nReduce])
+		}
+	}
+	mr.mu.Lock()
+	j.points = points
+	mr.mu.Unlock()
+	return nil
+}
+
+// up to SampleBytes from the start of a file, cut at the last complete
+// line.
+func readSample(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	b := make([]byte, SampleBytes)
+	n, err := io.ReadFull(file, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	sample := string(b[:n])
+	if n == SampleBytes {
+		sample = sample[:strings.LastIndex(sample, "\n")+1]
+	}
+	return sample, nil
+}
@@ -0,0 +1,91 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// the name the files of a pipeline stage are derived from; the first
+// stage works on the job's own name.
+func (j *jobImpl) stageFile(stage int) string {
+	if stage == 0 {
+		return j.name
+	}
+	return j.name + "-stage" + strconv.Itoa(stage)
+}
+
+// the number of map tasks of a stage: one per split of the input file
+// for the first, one per reduce output of the previous stage after that.
+func (j *jobImpl) stageMaps(stage int) int {
+	if stage == 0 {
+		return j.nMap
+	}
+	return j.nReduce
+}
+
+// switch to stage with none of its tasks done. mr.mu must be held.
+func (j *jobImpl) startStage(stage int) {
+	j.counters = j.totalCounters()
+	j.stage = stage
+	j.mapTasks = makePhaseImpl(j.stageMaps(stage))
+	j.rdcTasks = makePhaseImpl(j.nReduce)
+}
+
+// write the map inputs of stage (> 0): the reduce outputs of the
+// previous stage as "key\tvalue" lines, one split per output.
+func (j *jobImpl) prepareStage(stage int) error {
+	for r := 0; r < j.nReduce; r++ {
+		kvs, err := readKeyValues(MergeName(j.stageFile(stage-1), r))
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(MapName(j.stageFile(stage), r), func(w io.Writer) error {
+			for _, kv := range kvs {
+				if _, err := fmt.Fprintf(w, "%s\t%s\n", kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move the last stage's outputs to where the first stage's went, which
+// is where Merge expects the job's results, and remove the files of
+// the stages after the first, which no one needs any more.
+func (j *jobImpl) finishPipeline() error {
+	last := len(j.stages) - 1
+	if last == 0 {
+		return nil
+	}
+	for r := 0; r < j.nReduce; r++ {
+		if err := os.Rename(MergeName(j.stageFile(last), r), MergeName(j.name, r)); err != nil {
+			return err
+		}
+	}
+	j.removeFiles(1)
+	return nil
+}
+
+// remove the splits, intermediate files and reduce outputs of the
+// stages from first on.
+func (j *jobImpl) removeFiles(first int) {
+	for stage := first; stage < len(j.stages); stage++ {
+		file := j.stageFile(stage)
+		for m := 0; m < j.stageMaps(stage); m++ {
+			os.Remove(MapName(file, m))
+			for r := 0; r < j.nReduce; r++ {
+				os.Remove(ReduceName(file, m, r))
+			}
+		}
+		for r := 0; r < j.nReduce; r++ {
+			os.Remove(MergeName(file, r))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package mapreduce
+
+import "time"
+
+// In all data types that represent arguments to RPCs, field names
+// must start with capital letters, otherwise RPC will break.
+
+// per-job options chosen by the master and shipped with every task.
+type JobConf struct {
+	App     string // registered app to run; "" runs the workers' own Map/Reduce
+	Param   string
+	Combine bool // apply the app's combiner to each map task's output
+	// how map output keys are assigned to reduce tasks; one of
+	// HashPartition (the default), RangePartition or AppPartition.
+	Partitioner string
+	// failed attempts after which a task is quarantined: the job goes
+	// on without it, leaving its input out of the output.
+	// DefaultMaxAttempts if 0. LostAttemptsFactor times as many lost
+	// attempts quarantine it too.
+	MaxAttempts int
+	// leave out the records the app has panicked on in two attempts of
+	// a task, as the MapReduce paper's skip mode does. streaming tasks
+	// fail as a whole instead.
+	SkipBadRecords bool
+	// external executables, with their arguments, to run in place of
+	// the app's Map and Reduce, once per task; see streamingMap and
+	// doStreamingReduce.
+	Mapper  string
+	Reducer string
+}
+
+// arguments to the Worker.DoTask RPC: a DoJob plus the
+// registered app whose Map/Reduce functions the worker should run.
+type DoTaskArgs struct {
+	DoJobArgs
+	Conf        JobConf
+	SplitPoints []string // for RangePartition, sampled by the master
+	// records to leave out: the byte offsets of input lines for a map
+	// task, the keys for a reduce task.
+	Skip     []int64
+	SkipKeys []string
+	SkipMaps []int // quarantined map tasks, whose outputs a reduce task leaves out
+}
+
+type DoTaskReply struct {
+	OK          bool
+	BadRecords  []int64  // the app panicked on these, with SkipBadRecords; see Skip
+	BadKeys     []string // likewise for a reduce task; see SkipKeys
+	CorruptMaps []int    // map tasks whose outputs a reduce task could not read
+	Counters    Counters
+}
+
+// arguments to the MapReduce.Heartbeat RPC, sent periodically by
+// workers started with RunWorkerWithHeartbeats.
+type HeartbeatArgs struct {
+	Worker string
+}
+
+// OK is false if the master does not know the worker (e.g. it was
+// evicted after missing heartbeats), which should then register again.
+type HeartbeatReply struct {
+	OK bool
+}
+
+// arguments to the MapReduce.Advertise RPC, sent by workers started
+// with RunWorkerWithFiles: the files the worker holds locally.
+type AdvertiseArgs struct {
+	Worker string
+	Files  []string
+}
+
+type AdvertiseReply struct {
+	OK bool
+}
+
+// arguments to the MapReduce.Status RPC.
+type StatusArgs struct {
+	Job int // as returned by SubmitJob; 0 for a master running a single job
+}
+
+type TaskState string
+
+const (
+	TaskIdle        TaskState = "idle"
+	TaskInProgress  TaskState = "in-progress"
+	TaskDone        TaskState = "done"
+	TaskQuarantined TaskState = "quarantined"
+)
+
+type TaskStatus struct {
+	Job      int
+	State    TaskState
+	Workers  []string // running an attempt of the task
+	Attempts int
+	Failures int
+	Lost     int           // attempts lost with their worker
+	Skipped  int           // bad records left out
+	Elapsed  time.Duration // of the current attempt, or the one that completed it
+	Counters Counters      // once done
+}
+
+type WorkerStatus struct {
+	Address        string
+	Heartbeats     bool
+	SinceHeartbeat time.Duration
+	Task           string // e.g. "Map 3"; "" if idle
+}
+
+type StatusReply struct {
+	OK          bool // false if there is no such job
+	File        string
+	Phase       string // "Queued", "Starting", "Map", "Reduce", "Done" or "Failed"
+	Stage       int    // of the pipeline, counting from 0
+	Stages      int
+	MapTasks    []TaskStatus
+	ReduceTasks []TaskStatus
+	Workers     []WorkerStatus
+	Counters    Counters // summed over the completed tasks
+}
+
+// arguments to the MapReduce.Submit RPC: a job for a master started
+// with StartJobService.
+type SubmitArgs struct {
+	File     string
+	NMap     int
+	NReduce  int
+	Stages   []JobConf // as for MakeMapReducePipeline; none runs the workers' own Map/Reduce
+	Priority int       // relative share of the workers; 1 if not positive
+}
+
+type SubmitReply struct {
+	OK  bool
+	Job int
+	Err string // why the job was rejected
+}
+
+// arguments to the MapReduce.Jobs RPC.
+type JobsArgs struct {
+}
+
+type JobSummary struct {
+	Job      int
+	File     string
+	Priority int
+	Phase    string
+	Stage    int
+	Stages   int
+	Workers  int    // running the job's tasks right now
+	Output   string // the merged results, once Done
+	Err      string // why the job Failed
+	Counters Counters
+}
+
+type JobsReply struct {
+	Jobs []JobSummary
+}
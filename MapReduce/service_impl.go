@@ -0,0 +1,307 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// how the broker picks among jobs waiting for a worker. with
+// FairShare, the one holding the fewest workers per unit of priority;
+// with PriorityFirst, the one with the highest priority. workers are
+// never taken away from a running task, so shares even out as tasks
+// finish.
+const (
+	FairShare     = "fair"
+	PriorityFirst = "priority"
+)
+
+// at most MaxActiveJobs submitted jobs run at once; the rest wait
+// their turn in submission order.
+const MaxActiveJobs = 4
+
+// start a master that runs jobs submitted with SubmitJob, sharing the
+// workers that register with it among them according to policy
+// (FairShare if ""), until StopJobService.
+func StartJobService(master string, policy string) *MapReduce {
+	if policy == "" {
+		policy = FairShare
+	}
+	if policy != FairShare && policy != PriorityFirst {
+		log.Fatal("StartJobService: unknown policy ", policy)
+	}
+	mr := InitMapReduce(0, 0, "", master)
+	mr.impl.job = nil
+	delete(mr.impl.jobs, 0)
+	mr.impl.policy = policy
+	mr.StartRegistrationServer()
+	go mr.manageWorkers()
+	go mr.broker()
+	return mr
+}
+
+// stop a master started with StartJobService. running jobs fail and
+// queued ones never start.
+func (mr *MapReduce) StopJobService() {
+	close(mr.impl.finished)
+	mr.CleanupRegistration()
+}
+
+// MapReduce.Submit RPC handler: queue a job on a master started with
+// StartJobService.
+func (mr *MapReduce) Submit(args *SubmitArgs, reply *SubmitReply) error {
+	stages := args.Stages
+	if len(stages) == 0 {
+		stages = []JobConf{{}}
+	}
+	if args.NMap <= 0 || args.NReduce <= 0 {
+		reply.Err = "NMap and NReduce must be positive"
+		return nil
+	}
+	if err := checkStages(stages); err != nil {
+		reply.Err = err.Error()
+		return nil
+	}
+	priority := args.Priority
+	if priority <= 0 {
+		priority = 1
+	}
+
+	mr.mu.Lock()
+	if mr.impl.job != nil {
+		mr.mu.Unlock()
+		reply.Err = "not a job service"
+		return nil
+	}
+	id := mr.impl.nextJob
+	mr.impl.nextJob++
+	j := makeJobImpl(id, args.File, args.File+"-job"+strconv.Itoa(id),
+		args.NMap, args.NReduce, stages, priority)
+	j.phase = "Queued"
+	mr.impl.jobs[id] = j
+	mr.mu.Unlock()
+
+	fmt.Printf("job %d submitted: %s\n", id, args.File)
+	go mr.serveJob(j)
+	reply.OK = true
+	reply.Job = id
+	return nil
+}
+
+// MapReduce.Jobs RPC handler: every job submitted so far.
+func (mr *MapReduce) Jobs(args *JobsArgs, reply *JobsReply) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	reply.Jobs = make([]JobSummary, 0, len(mr.impl.jobs))
+	for _, j := range mr.impl.jobs {
+		js := JobSummary{Job: j.id, File: j.file, Priority: j.priority, Phase: j.phase,
+			Stage: j.stage, Stages: len(j.stages), Workers: j.lent, Output: j.output,
+			Counters: j.totalCounters()}
+		if j.err != nil {
+			js.Err = j.err.Error()
+		}
+		reply.Jobs = append(reply.Jobs, js)
+	}
+	sort.Slice(reply.Jobs, func(a, b int) bool {
+		return reply.Jobs[a].Job < reply.Jobs[b].Job
+	})
+	return nil
+}
+
+// run a submitted job once it is admitted: split its input, run its
+// stages, merge the results into "mrtmp." plus the job's name, and
+// remove everything else it wrote.
+func (mr *MapReduce) serveJob(j *jobImpl) {
+	select {
+	case mr.impl.slots <- true:
+	case <-mr.impl.finished:
+		return
+	}
+	defer func() { <-mr.impl.slots }()
+	mr.mu.Lock()
+	j.phase = "Starting"
+	mr.mu.Unlock()
+
+	err := splitInput(j.file, j.name, j.nMap)
+	if err == nil {
+		err = mr.runJob(j)
+	}
+	if err == nil {
+		err = j.mergeOutputs("mrtmp." + j.name)
+	}
+	j.removeFiles(0)
+	j.removeCheckpoint()
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.forgetFiles("mrtmp." + j.name + "-")
+	if err != nil {
+		fmt.Printf("job %d failed: %v\n", j.id, err)
+		j.phase = "Failed"
+		j.err = err
+		return
+	}
+	fmt.Printf("job %d done\n", j.id)
+	j.phase = "Done"
+	j.output = "mrtmp." + j.name
+}
+
+// like Split, but always writes exactly nmap splits, some possibly
+// empty, so that small inputs work with any number of map tasks.
+func splitInput(file string, name string, nmap int) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	chunk := len(b)/nmap + 1
+	start := 0
+	for m := 0; m < nmap; m++ {
+		end := len(b)
+		if m < nmap-1 && (m+1)*chunk < len(b) {
+			end = (m + 1) * chunk
+			if end < start {
+				end = start
+			}
+			if i := bytes.IndexByte(b[end:], '\n'); i >= 0 {
+				end += i + 1
+			} else {
+				end = len(b)
+			}
+		}
+		if err := os.WriteFile(MapName(name, m), b[start:end], 0644); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// like Merge, for a job's own outputs.
+func (j *jobImpl) mergeOutputs(output string) error {
+	kvs := make(map[string]string)
+	for r := 0; r < j.nReduce; r++ {
+		results, err := readKeyValues(MergeName(j.name, r))
+		if err != nil {
+			return err
+		}
+		for _, kv := range results {
+			kvs[kv.Key] = kv.Value
+		}
+	}
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return writeFileAtomic(output, func(w io.Writer) error {
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s: %s\n", k, kvs[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hand free workers to the jobs asking for one, for as long as the
+// master runs. every job has at most one request outstanding, and the
+// broker never blocks.
+func (mr *MapReduce) broker() {
+	free := make([]*WorkerInfo, 0)
+	wanting := make([]*jobImpl, 0)
+	for {
+		select {
+		case w := <-mr.impl.free:
+			free = append(free, w)
+		case j := <-mr.impl.wants:
+			wanting = append(wanting, j)
+		case <-mr.impl.finished:
+			return
+		}
+
+		mr.mu.Lock()
+		for len(free) > 0 && len(wanting) > 0 {
+			w := free[0]
+			if !w.impl.alive {
+				free = free[1:]
+				continue
+			}
+			i := mr.pickJob(wanting)
+			j := wanting[i]
+			wanting = append(wanting[:i], wanting[i+1:]...)
+			if j.over {
+				continue
+			}
+			free = free[1:]
+			j.lent++
+			j.idle <- w
+		}
+		mr.mu.Unlock()
+	}
+}
+
+// the index of the job in jobs that should get the next free worker
+// under mr.impl.policy. mr.mu must be held.
+func (mr *MapReduce) pickJob(jobs []*jobImpl) int {
+	before := func(a *jobImpl, b *jobImpl) bool {
+		if mr.impl.policy == PriorityFirst && a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.lent*b.priority != b.lent*a.priority {
+			return a.lent*b.priority < b.lent*a.priority
+		}
+		return a.id < b.id
+	}
+	best := 0
+	for i := range jobs {
+		if before(jobs[i], jobs[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// ask the broker for a worker for j, to be delivered on j.idle.
+func (mr *MapReduce) askForWorker(j *jobImpl) {
+	select {
+	case mr.impl.wants <- j:
+	case <-mr.impl.finished:
+	}
+}
+
+// j needs no more workers; give back the one granted to it, if any.
+func (mr *MapReduce) endJob(j *jobImpl) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	j.over = true
+	select {
+	case w := <-j.idle:
+		go mr.release(j, w)
+	default:
+	}
+}
+
+// submit a job to the master at address, which must have been started
+// with StartJobService; returns the job's id.
+func SubmitJob(master string, args SubmitArgs) (int, error) {
+	var reply SubmitReply
+	if ok := call(master, "MapReduce.Submit", &args, &reply); !ok {
+		return 0, fmt.Errorf("master %s unreachable", master)
+	}
+	if !reply.OK {
+		return 0, fmt.Errorf("%s", reply.Err)
+	}
+	return reply.Job, nil
+}
+
+// list the jobs submitted to the master at address; false if it cannot
+// be reached.
+func ListJobs(master string) ([]JobSummary, bool) {
+	var reply JobsReply
+	ok := call(master, "MapReduce.Jobs", &JobsArgs{}, &reply)
+	return reply.Jobs, ok
+}
@@ -0,0 +1,80 @@
+package mapreduce
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MapReduce.Status RPC handler: what the master is doing right now,
+// for operators diagnosing a stuck job.
+func (mr *MapReduce) Status(args *StatusArgs, reply *StatusReply) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	j, ok := mr.impl.jobs[args.Job]
+	if !ok {
+		reply.OK = false
+		return nil
+	}
+	reply.OK = true
+	reply.File = j.file
+	reply.Phase = j.phase
+	reply.Stage = j.stage
+	reply.Stages = len(j.stages)
+	reply.MapTasks = mr.taskStatus(j, Map, &j.mapTasks)
+	reply.ReduceTasks = mr.taskStatus(j, Reduce, &j.rdcTasks)
+	reply.Counters = j.totalCounters()
+	reply.Workers = make([]WorkerStatus, 0, len(mr.Workers))
+	for _, w := range mr.Workers {
+		ws := WorkerStatus{Address: w.address, Heartbeats: w.impl.heartbeats,
+			SinceHeartbeat: time.Since(w.impl.lastHeartbeat)}
+		if att := w.impl.current; att != nil {
+			ws.Task = string(att.operation) + " " + strconv.Itoa(att.job)
+			if att.j.id != 0 {
+				ws.Task = "job " + strconv.Itoa(att.j.id) + " " + ws.Task
+			}
+		}
+		reply.Workers = append(reply.Workers, ws)
+	}
+	sort.Slice(reply.Workers, func(i, j int) bool {
+		return reply.Workers[i].Address < reply.Workers[j].Address
+	})
+	return nil
+}
+
+// mr.mu must be held.
+func (mr *MapReduce) taskStatus(j *jobImpl, operation JobType, phase *phaseImpl) []TaskStatus {
+	tasks := make([]TaskStatus, len(phase.completed))
+	for job := range tasks {
+		ts := TaskStatus{Job: job, State: TaskIdle, Attempts: phase.attempts[job],
+			Failures: phase.failures[job], Lost: phase.lost[job], Skipped: len(phase.skip[job]) + len(phase.skipKeys[job]),
+			Counters: phase.counters[job]}
+		if phase.quarantined[job] {
+			ts.State = TaskQuarantined
+		} else if phase.completed[job] {
+			ts.State = TaskDone
+			if !phase.started[job].IsZero() {
+				ts.Elapsed = phase.finished[job].Sub(phase.started[job])
+			}
+		} else if phase.running[job] > 0 {
+			ts.State = TaskInProgress
+			ts.Elapsed = time.Since(phase.started[job])
+		}
+		tasks[job] = ts
+	}
+	for _, w := range mr.Workers {
+		if att := w.impl.current; att != nil && att.j == j && att.stage == j.stage &&
+			att.operation == operation {
+			tasks[att.job].Workers = append(tasks[att.job].Workers, w.address)
+		}
+	}
+	return tasks
+}
+
+// ask the master at address for the status of job (0 unless it runs
+// submitted jobs); false if it cannot be reached or has no such job.
+func GetStatus(master string, job int) (StatusReply, bool) {
+	var reply StatusReply
+	ok := call(master, "MapReduce.Status", &StatusArgs{Job: job}, &reply)
+	return reply, ok && reply.OK
+}
@@ -0,0 +1,87 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// streaming runs an external executable in place of Map or Reduce,
+// once per task, with the task's input on its stdin and its output read
+// from its stdout, both as "key\tvalue" lines (a line without a tab is
+// a key with an empty value). keys may not contain tabs or newlines,
+// nor values newlines. the executable finds the task in $MR_OPERATION
+// and $MR_TASK, and fails the task by exiting with a non-zero status.
+
+// a Map function that feeds its value to the mapper command. a failed
+// run panics, which fails the task like any other panic in Map; but
+// the task's records are not tried one by one to find the bad ones,
+// as that would start the mapper once per record, so SkipBadRecords
+// does not apply to it.
+func streamingMap(command string, job int) func(string) []KeyValue {
+	return func(value string) []KeyValue {
+		output, err := runStreaming(command, Map, job, value)
+		if err != nil {
+			panic(err)
+		}
+		return output
+	}
+}
+
+// like doReduceImpl, but the reducer command gets every value of the
+// task's keys, in key order, and writes the task's output.
+func doStreamingReduce(job int, fileName string, nmap int, skipMaps map[int]bool,
+	command string, skip map[string]bool, counters Counters) error {
+	keys, kvs, err := readReduceInputs(job, fileName, nmap, skipMaps)
+	if err != nil {
+		return err
+	}
+	var input strings.Builder
+	for _, k := range keys {
+		if skip[k] {
+			counters.Add(SkippedRecords, 1)
+			continue
+		}
+		counters.Add(ReduceInputGroups, 1)
+		counters.Add(ReduceInputRecords, int64(len(kvs[k])))
+		for _, v := range kvs[k] {
+			input.WriteString(k + "\t" + v + "\n")
+		}
+	}
+	output, err := runStreaming(command, Reduce, job, input.String())
+	if err != nil {
+		return err
+	}
+	counters.Add(ReduceOutputRecords, int64(len(output)))
+	return writeKeyValues(MergeName(fileName, job), output)
+}
+
+// run command with input on its stdin and parse its stdout.
+func runStreaming(command string, operation JobType, job int, input string) ([]KeyValue, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty %s command", operation)
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), "MR_OPERATION="+string(operation),
+		"MR_TASK="+strconv.Itoa(job))
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	output := make([]KeyValue, 0)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "\t")
+		output = append(output, KeyValue{Key: key, Value: value})
+	}
+	return output, nil
+}
@@ -0,0 +1,152 @@
+package mapreduce
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// how word count splits text into words. the zero value splits at
+// every rune that is not a letter, as WCMap does.
+type Tokenizer struct {
+	FoldCase bool // count "The" and "the" as the same word
+	// put the text in Unicode normalization form NFKC first, so that
+	// "café" is one word however it is encoded and fullwidth forms count
+	// as their ASCII letters, and keep combining marks with their letters.
+	// this uses golang.org/x/text/unicode/norm, which is vendored in
+	// vendor/ (its Unicode 15 tables need Go 1.21), as the GOPATH layout
+	// has no module to fetch it.
+	Normalize   bool
+	Numbers     bool // numbers are words too, instead of separators
+	Apostrophes bool // keep "don't" and "l'été" whole
+	Hyphens     bool // keep "well-known" whole
+	// count each Han, Hiragana or Katakana character as a word, since
+	// those scripts do not separate words with spaces.
+	Ideographs bool
+	Stopwords  []string // words to leave out, before n-grams are formed
+	NGram      int      // emit runs of NGram consecutive words instead of words, if > 1
+}
+
+// parse a tokenizer configuration such as
+// "fold,normalize,apostrophes,stopwords=the|a|an,ngram=2": a
+// comma-separated list of fold, normalize, numbers, apostrophes,
+// hyphens, ideographs, stopwords=w1|w2|... and ngram=n.
+func ParseTokenizer(config string) (Tokenizer, error) {
+	var tok Tokenizer
+	for _, opt := range strings.Split(config, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch name {
+		case "":
+		case "fold":
+			tok.FoldCase = true
+		case "normalize":
+			tok.Normalize = true
+		case "numbers":
+			tok.Numbers = true
+		case "apostrophes":
+			tok.Apostrophes = true
+		case "hyphens":
+			tok.Hyphens = true
+		case "ideographs":
+			tok.Ideographs = true
+		case "stopwords":
+			tok.Stopwords = strings.Split(value, "|")
+		case "ngram":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Tokenizer{}, fmt.Errorf("tokenizer: bad ngram %q", value)
+			}
+			tok.NGram = n
+		default:
+			return Tokenizer{}, fmt.Errorf("tokenizer: unknown option %q", name)
+		}
+	}
+	return tok, nil
+}
+
+// a Map function that counts the words tok finds, like WCMap.
+func (tok Tokenizer) WCMap() func(string) []KeyValue {
+	stop := make(map[string]bool)
+	for _, w := range tok.Stopwords {
+		for _, s := range tok.Words(w) {
+			stop[s] = true
+		}
+	}
+	return func(value string) []KeyValue {
+		words := make([]string, 0)
+		for _, w := range tok.Words(value) {
+			if !stop[w] {
+				words = append(words, w)
+			}
+		}
+		if tok.NGram > 1 {
+			words = ngrams(words, tok.NGram)
+		}
+		intermediate := make([]KeyValue, 0, len(words))
+		for _, w := range words {
+			intermediate = append(intermediate, KeyValue{Key: w, Value: "1"})
+		}
+		return intermediate
+	}
+}
+
+// split text into words, without removing stopwords.
+func (tok Tokenizer) Words(text string) []string {
+	if tok.Normalize {
+		text = norm.NFKC.String(text)
+	}
+	runes := []rune(text)
+	words := make([]string, 0)
+	word := make([]rune, 0)
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+			word = word[:0]
+		}
+	}
+	// whether runes[i] is followed by a rune that can start a word,
+	// e.g. for an apostrophe inside a word.
+	joins := func(i int) bool {
+		return i+1 < len(runes) && (unicode.IsLetter(runes[i+1]) ||
+			tok.Numbers && unicode.IsNumber(runes[i+1]))
+	}
+	for i, r := range runes {
+		if tok.FoldCase {
+			r = unicode.ToLower(unicode.ToUpper(r))
+		}
+		switch {
+		case tok.Ideographs && isIdeograph(r):
+			flush()
+			word = append(word, r)
+			flush()
+		case unicode.IsLetter(r), tok.Numbers && unicode.IsNumber(r):
+			word = append(word, r)
+		case tok.Normalize && unicode.Is(unicode.M, r) && len(word) > 0:
+			word = append(word, r)
+		case tok.Apostrophes && (r == '\'' || r == '\u2019') && len(word) > 0 && joins(i):
+			word = append(word, '\'')
+		case tok.Hyphens && (r == '-' || r == '\u2010') && len(word) > 0 && joins(i):
+			word = append(word, '-')
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// every run of n consecutive words, joined by spaces.
+func ngrams(words []string, n int) []string {
+	grams := make([]string, 0)
+	for i := 0; i+n <= len(words); i++ {
+		grams = append(grams, strings.Join(words[i:i+n], " "))
+	}
+	return grams
+}
@@ -0,0 +1,91 @@
+package mapreduce
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizerWords(t *testing.T) {
+	tests := []struct {
+		config string
+		text   string
+		want   []string
+	}{
+		{"", "Hello, world! 42 times", []string{"Hello", "world", "times"}},
+		{"fold", "The the THE", []string{"the", "the", "the"}},
+		{"numbers", "route 66", []string{"route", "66"}},
+		// precomposed and decomposed é are the same word once normalized
+		{"", "café cafe\u0301", []string{"café", "cafe"}},
+		{"normalize", "café cafe\u0301", []string{"café", "café"}},
+		{"normalize", "Ｗｏｒｄ", []string{"Word"}},
+		{"normalize,fold", "ÉTÉ été", []string{"été", "été"}},
+		{"", "don't stop", []string{"don", "t", "stop"}},
+		{"apostrophes", "don't l’été 'quoted'", []string{"don't", "l'été", "quoted"}},
+		{"hyphens", "well-known - x- -y", []string{"well-known", "x", "y"}},
+		{"", "東京タワー", []string{"東京タワー"}},
+		{"ideographs", "東京タワー is tall", []string{"東", "京", "タ", "ワ", "ー", "is", "tall"}},
+		{"ideographs", "Москва и 北京", []string{"Москва", "и", "北", "京"}},
+		{"", "ελληνικά, русский; العربية", []string{"ελληνικά", "русский", "العربية"}},
+	}
+	for _, test := range tests {
+		tok, err := ParseTokenizer(test.config)
+		if err != nil {
+			t.Fatalf("ParseTokenizer(%q): %v", test.config, err)
+		}
+		if got := tok.Words(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: Words(%q) = %q, want %q", test.config, test.text, got, test.want)
+		}
+	}
+}
+
+func TestWCMapWith(t *testing.T) {
+	tests := []struct {
+		config string
+		text   string
+		want   []string
+	}{
+		{"", "a b, c", []string{"a", "b", "c"}},
+		{"stopwords=the|a", "the cat sat on a mat", []string{"cat", "sat", "on", "mat"}},
+		{"fold,stopwords=the", "The cat saw the dog", []string{"cat", "saw", "dog"}},
+		{"ngram=2", "one two three", []string{"one two", "two three"}},
+		{"ngram=3", "one two", []string{}},
+		{"ngram=2,stopwords=of", "top of the world", []string{"top the", "the world"}},
+		{"ngram=2,ideographs", "日本語", []string{"日 本", "本 語"}},
+		{"ngram=2,normalize,fold", "Cafe\u0301 CAFÉ", []string{"café café"}},
+	}
+	for _, test := range tests {
+		mapF, err := WCMapWith(test.config)
+		if err != nil {
+			t.Fatalf("WCMapWith(%q): %v", test.config, err)
+		}
+		got := make([]string, 0)
+		for _, kv := range mapF(test.text) {
+			if kv.Value != "1" {
+				t.Errorf("%q: value %q for %q", test.config, kv.Value, kv.Key)
+			}
+			got = append(got, kv.Key)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: keys of %q = %q, want %q", test.config, test.text, got, test.want)
+		}
+	}
+}
+
+func TestWCMapWithDefault(t *testing.T) {
+	text := "It's a well-known café, 東京 100%."
+	mapF, err := WCMapWith("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mapF(text), WCMap(text); !reflect.DeepEqual(got, want) {
+		t.Errorf("WCMapWith(\"\") = %v, WCMap = %v", got, want)
+	}
+}
+
+func TestParseTokenizerErrors(t *testing.T) {
+	for _, config := range []string{"ngram=0", "ngram=x", "stem"} {
+		if _, err := ParseTokenizer(config); err == nil {
+			t.Errorf("ParseTokenizer(%q) succeeded", config)
+		}
+	}
+}
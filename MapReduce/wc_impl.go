@@ -34,6 +34,16 @@ func WCMap(value string) []KeyValue {
 	return intermediate
 }
 
+// like WCMap, but splits the input into words as the tokenizer
+// configuration config says (see ParseTokenizer); "" splits as WCMap.
+func WCMapWith(config string) (func(string) []KeyValue, error) {
+	tok, err := ParseTokenizer(config)
+	if err != nil {
+		return nil, err
+	}
+	return tok.WCMap(), nil
+}
+
 // called once for each key generated by Map, with a list of that
 // key's values. should return a single output value for that key.
 func WCReduce(key string, values []string) string {
@@ -48,7 +58,9 @@ func WCReduce(key string, values []string) string {
 	for _, v := range values {
 		n, err := strconv.Atoi(v)
 		if err != nil {
-			log.Fatal(err)
+			// panic rather than exit, so the worker survives to
+			// report the bad record.
+			panic(err)
 		}
 
 		result += n
@@ -56,3 +68,25 @@ func WCReduce(key string, values []string) string {
 
 	return strconv.Itoa(result)
 }
+
+// the words counter of the wc app.
+const WCWords = "words"
+
+// the malformed counts counter of WCReduceCounting.
+const WCMalformed = "malformed counts"
+
+// like WCReduce, but counts and skips values that are not integers
+// instead of failing.
+func WCReduceCounting(key string, values []string, counters Counters) string {
+	result := 0
+	for _, v := range values {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("WCReduce: %s: %v\n", key, err)
+			counters.Add(WCMalformed, 1)
+			continue
+		}
+		result += n
+	}
+	return strconv.Itoa(result)
+}
@@ -0,0 +1,384 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Worker.DoTask RPC handler: like DoJob, but runs the registered app
+// named in args (or the worker's own Map/Reduce if none is named, and
+// the external Mapper and Reducer executables if there are any), and
+// commits its output atomically so that duplicate attempts of the same
+// task, e.g. speculative backups, are harmless. a panic in the app
+// fails the task instead of the worker; with SkipBadRecords, the reply
+// names the records (or keys) it panicked on.
+func (wk *Worker) DoTask(args *DoTaskArgs, res *DoTaskReply) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("DoTask: %s %d: panic: %v\n", args.Operation, args.JobNumber, r)
+			res.OK = false
+		}
+	}()
+	app := App{Map: wk.Map, Reduce: wk.Reduce}
+	var err error
+	if args.Conf.App != "" {
+		app, err = LookupApp(args.Conf.App, args.Conf.Param)
+	}
+	if err != nil {
+		log.Printf("DoTask: %s %d: %v\n", args.Operation, args.JobNumber, err)
+		res.OK = false
+		return nil
+	}
+	skip := makeSkipSet(args.Skip)
+	skipKeys := make(map[string]bool)
+	for _, k := range args.SkipKeys {
+		skipKeys[k] = true
+	}
+	skipMaps := make(map[int]bool)
+	for _, m := range args.SkipMaps {
+		skipMaps[m] = true
+	}
+	counters := make(Counters)
+	mapF, reduceF := app.withCounters(counters)
+	findBad := args.Conf.SkipBadRecords
+	if args.Conf.Mapper != "" {
+		mapF = streamingMap(args.Conf.Mapper, args.JobNumber)
+		// finding the bad records would run the mapper once per line.
+		findBad = false
+	}
+	switch args.Operation {
+	case Map:
+		var combine func(string, []string) string
+		if args.Conf.Combine {
+			combine = app.Combine
+		}
+		partition := makePartition(args.Conf.Partitioner, app, args.SplitPoints)
+		err = doMapImpl(args.JobNumber, args.File, args.NumOtherPhase, mapF, combine, partition,
+			skip, findBad, counters)
+	case Reduce:
+		if args.Conf.Reducer != "" {
+			err = doStreamingReduce(args.JobNumber, args.File, args.NumOtherPhase, skipMaps,
+				args.Conf.Reducer, skipKeys, counters)
+		} else {
+			err = doReduceImpl(args.JobNumber, args.File, args.NumOtherPhase, skipMaps, reduceF,
+				skipKeys, args.Conf.SkipBadRecords, counters)
+		}
+	}
+	if err != nil {
+		log.Printf("DoTask: %s %d: %v\n", args.Operation, args.JobNumber, err)
+		if bad, ok := err.(*badRecordsError); ok {
+			res.BadRecords = bad.records
+			res.BadKeys = bad.keys
+		}
+		if corrupt, ok := err.(*corruptInputError); ok {
+			res.CorruptMaps = corrupt.maps
+		}
+		res.OK = false
+		return nil
+	}
+	res.OK = true
+	res.Counters = counters
+	return nil
+}
+
+// user code panicked on the records of a map task at these offsets,
+// or on these keys of a reduce task.
+type badRecordsError struct {
+	records []int64
+	keys    []string
+	cause   interface{} // what the first of them panicked with
+}
+
+func (e *badRecordsError) Error() string {
+	return fmt.Sprintf("%v, on %d records", e.cause, len(e.records)+len(e.keys))
+}
+
+func makeSkipSet(records []int64) map[int64]bool {
+	skip := make(map[int64]bool)
+	for _, off := range records {
+		skip[off] = true
+	}
+	return skip
+}
+
+// call f, turning a panic into an error.
+func protect(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// like RunWorker, but the worker also heartbeats the master every
+// HeartbeatInterval, and registers again if the master has evicted it.
+func RunWorkerWithHeartbeats(MasterAddress string, me string,
+	MapFunc func(string) []KeyValue, ReduceFunc func(string, []string) string,
+	nRPC int) {
+	stop := make(chan bool)
+	go heartbeat(MasterAddress, me, nil, stop)
+	RunWorker(MasterAddress, me, MapFunc, ReduceFunc, nRPC)
+	close(stop)
+}
+
+// files, if not nil, lists the files to advertise when registering
+// again; see RunWorkerWithFiles.
+func heartbeat(master string, me string, files func() []string, stop chan bool) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			args, reply := &HeartbeatArgs{Worker: me}, HeartbeatReply{}
+			if ok := call(master, "MapReduce.Heartbeat", args, &reply); ok && !reply.OK {
+				if files != nil {
+					advertise(master, me, files)
+				}
+				Register(master, me)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// like DoMap, but partitions the Map output with partition first so
+// that combine, if not nil, can pre-aggregate each reduce partition
+// before it is written to the intermediate file. the input lines at
+// the byte offsets in skip are left out; if mapF panics and findBad is
+// set, the lines it panics on are found and returned in a
+// *badRecordsError. the task's own counters are added to counters.
+func doMapImpl(job int, fileName string, nreduce int,
+	mapF func(string) []KeyValue, combine func(string, []string) string,
+	partition func(string, int) int, skip map[int64]bool, findBad bool,
+	counters Counters) error {
+	b, err := os.ReadFile(MapName(fileName, job))
+	if err != nil {
+		return err
+	}
+	lines, offsets := splitLines(string(b))
+	value, kept := string(b), len(lines)
+	if len(skip) > 0 {
+		keep := make([]string, 0, len(lines))
+		for i, line := range lines {
+			if !skip[offsets[i]] {
+				keep = append(keep, line)
+			}
+		}
+		value, kept = strings.Join(keep, ""), len(keep)
+		counters.Add(SkippedRecords, int64(len(lines)-kept))
+	}
+	counters.Add(MapInputBytes, int64(len(value)))
+	counters.Add(MapInputRecords, int64(kept))
+	var output []KeyValue
+	if err := protect(func() { output = mapF(value) }); err != nil {
+		if !findBad {
+			return err
+		}
+		// run mapF on one line at a time to find the culprits.
+		bad := &badRecordsError{cause: err}
+		for i, line := range lines {
+			if !skip[offsets[i]] && protect(func() { mapF(line) }) != nil {
+				bad.records = append(bad.records, offsets[i])
+			}
+		}
+		if len(bad.records) == 0 {
+			return err
+		}
+		return bad
+	}
+	counters.Add(MapOutputRecords, int64(len(output)))
+	partitions := make([][]KeyValue, nreduce)
+	for _, kv := range output {
+		r := partition(kv.Key, nreduce)
+		if r < 0 || r >= nreduce {
+			return fmt.Errorf("partition %d out of range [0,%d) for key %q", r, nreduce, kv.Key)
+		}
+		partitions[r] = append(partitions[r], kv)
+	}
+	for r, kvs := range partitions {
+		if combine != nil {
+			kvs = combineKeyValues(kvs, combine)
+		}
+		if err := writeIntermediate(ReduceName(fileName, job, r), kvs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// group kvs by key, keeping the order in which keys first appear,
+// and replace each group by combine's result.
+func combineKeyValues(kvs []KeyValue, combine func(string, []string) string) []KeyValue {
+	keys := make([]string, 0)
+	values := make(map[string][]string)
+	for _, kv := range kvs {
+		if _, exist := values[kv.Key]; !exist {
+			keys = append(keys, kv.Key)
+		}
+		values[kv.Key] = append(values[kv.Key], kv.Value)
+	}
+	combined := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		combined = append(combined, KeyValue{Key: k, Value: combine(k, values[k])})
+	}
+	return combined
+}
+
+// split value into lines, each with its newline, and their byte
+// offsets in value.
+func splitLines(value string) ([]string, []int64) {
+	lines := strings.SplitAfter(value, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	offsets := make([]int64, len(lines))
+	off := int64(0)
+	for i, line := range lines {
+		offsets[i] = off
+		off += int64(len(line))
+	}
+	return lines, offsets
+}
+
+// like DoReduce, but the output file is committed atomically, and
+// intermediate files that are missing or corrupt are reported in a
+// *corruptInputError so their map tasks can be run again; those of the
+// map tasks in skipMaps, which were quarantined, are left out. the keys
+// in skip are left out; if reduceF panics and findBad is set, all the
+// keys it panics on are returned in a *badRecordsError. the task's own
+// counters are added to counters.
+func doReduceImpl(job int, fileName string, nmap int, skipMaps map[int]bool,
+	reduceF func(string, []string) string, skip map[string]bool, findBad bool,
+	counters Counters) error {
+	keys, kvs, err := readReduceInputs(job, fileName, nmap, skipMaps)
+	if err != nil {
+		return err
+	}
+	output := make([]KeyValue, 0, len(keys))
+	bad := &badRecordsError{}
+	for _, k := range keys {
+		if skip[k] {
+			counters.Add(SkippedRecords, 1)
+			continue
+		}
+		counters.Add(ReduceInputGroups, 1)
+		counters.Add(ReduceInputRecords, int64(len(kvs[k])))
+		var v string
+		if err := protect(func() { v = reduceF(k, kvs[k]) }); err != nil {
+			if !findBad {
+				return err
+			}
+			if bad.cause == nil {
+				bad.cause = err
+			}
+			bad.keys = append(bad.keys, k)
+			continue
+		}
+		output = append(output, KeyValue{Key: k, Value: v})
+	}
+	if len(bad.keys) > 0 {
+		return bad
+	}
+	counters.Add(ReduceOutputRecords, int64(len(output)))
+	return writeKeyValues(MergeName(fileName, job), output)
+}
+
+// read the intermediate files of reduce task job, except those of the
+// map tasks in skipMaps, and group their values by key; also returns
+// the keys in sorted order.
+func readReduceInputs(job int, fileName string, nmap int,
+	skipMaps map[int]bool) ([]string, map[string][]string, error) {
+	kvs := make(map[string][]string)
+	corrupt := &corruptInputError{}
+	for i := 0; i < nmap; i++ {
+		if skipMaps[i] {
+			continue
+		}
+		intermediate, err := readIntermediate(ReduceName(fileName, i, job))
+		if _, ok := err.(*corruptFileError); ok {
+			if corrupt.cause == nil {
+				corrupt.cause = err
+			}
+			corrupt.maps = append(corrupt.maps, i)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		for _, kv := range intermediate {
+			kvs[kv.Key] = append(kvs[kv.Key], kv.Value)
+		}
+	}
+	if len(corrupt.maps) > 0 {
+		return nil, nil, corrupt
+	}
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, kvs, nil
+}
+
+// read a file of JSON-encoded KeyValues as written by writeKeyValues.
+func readKeyValues(name string) ([]KeyValue, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	kvs := make([]KeyValue, 0)
+	dec := json.NewDecoder(file)
+	for {
+		var kv KeyValue
+		if err := dec.Decode(&kv); err == io.EOF {
+			return kvs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read %s: %v", name, err)
+		}
+		kvs = append(kvs, kv)
+	}
+}
+
+// write kvs to name in the JSON format Merge reads.
+func writeKeyValues(name string, kvs []KeyValue) error {
+	return writeFileAtomic(name, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, kv := range kvs {
+			if err := enc.Encode(&kv); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// write a file through a temporary file that is renamed into place,
+// so readers never see a partial file and a duplicate attempt just
+// replaces it with the same content. nothing is synced: unlike proj2's
+// common.WriteFileAtomic, a lost output is just recomputed.
+func writeFileAtomic(name string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("write %s: %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
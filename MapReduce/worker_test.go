@@ -0,0 +1,73 @@
+package mapreduce
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// a reduce function that panics on some keys.
+func panickyReduce(key string, values []string) string {
+	if key == "bad" || key == "worse" {
+		panic("cannot reduce " + key)
+	}
+	return WCReduce(key, values)
+}
+
+// run a map task over text in a scratch directory, so that a reduce
+// task can read its output.
+func mapForReduce(t *testing.T, name string, text string) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+	if err := os.WriteFile(MapName(name, 0), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	partition := func(string, int) int { return 0 }
+	if err := doMapImpl(0, name, 1, WCMap, nil, partition, nil, false, Counters{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReduceReportsBadKeys(t *testing.T) {
+	mapForReduce(t, "reduce-bad", "good bad good worse\n")
+	err := doReduceImpl(0, "reduce-bad", 1, nil, panickyReduce, nil, true, Counters{})
+	bad, ok := err.(*badRecordsError)
+	if !ok {
+		t.Fatalf("got %v, want a *badRecordsError", err)
+	}
+	if want := []string{"bad", "worse"}; !reflect.DeepEqual(bad.keys, want) {
+		t.Fatalf("bad keys %v, want %v", bad.keys, want)
+	}
+	if _, err := os.Stat(MergeName("reduce-bad", 0)); err == nil {
+		t.Fatalf("a failed reduce task wrote its output")
+	}
+}
+
+func TestReduceSkipsKeys(t *testing.T) {
+	mapForReduce(t, "reduce-skip", "good bad good worse\n")
+	counters := Counters{}
+	skip := map[string]bool{"bad": true, "worse": true}
+	if err := doReduceImpl(0, "reduce-skip", 1, nil, panickyReduce, skip, true, counters); err != nil {
+		t.Fatal(err)
+	}
+	if counters[SkippedRecords] != 2 {
+		t.Fatalf("skipped %d records, want 2", counters[SkippedRecords])
+	}
+}
+
+func TestReduceWithoutSkipping(t *testing.T) {
+	mapForReduce(t, "reduce-noskip", "bad\n")
+	err := doReduceImpl(0, "reduce-noskip", 1, nil, panickyReduce, nil, false, Counters{})
+	if err == nil {
+		t.Fatalf("reduce succeeded although reduceF panicked")
+	}
+	if _, ok := err.(*badRecordsError); ok {
+		t.Fatalf("got %v, want the panic itself", err)
+	}
+}
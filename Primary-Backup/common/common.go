@@ -0,0 +1,17 @@
+package common
+
+import (
+	"net/rpc"
+)
+
+// send an RPC to srv over a unix socket and wait for the reply.
+// returns true if the server responded, false if it could not be
+// reached.
+func Call(srv string, name string, args interface{}, reply interface{}) bool {
+	c, err := rpc.Dial("unix", srv)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	return c.Call(name, args, reply) == nil
+}
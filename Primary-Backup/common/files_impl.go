@@ -0,0 +1,41 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// write b to the file name, so that it has either its old contents or
+// b even after a crash: b goes to a temporary file that is synced and
+// renamed into place, and then the directory is synced, since until
+// then a crash can bring the old file back.
+func WriteFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
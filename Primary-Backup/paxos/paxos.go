@@ -0,0 +1,92 @@
+package paxos
+
+//
+// the parts of proj3's paxos package that are not in paxos_impl.go,
+// cut down to what the replicated viewservice uses:
+//
+// px = paxos.Make(peers []string, me int, rpcs *rpc.Server)
+// px.Start(seq int, v interface{}) -- start agreement on new instance
+// px.Status(seq int) (Fate, v interface{}) -- get info about an instance
+// px.Done(seq int) -- ok to forget all instances <= seq
+// px.Max() int -- highest instance seq known
+// px.Min() int -- instances before this seq have been forgotten
+// px.Kill() -- stop the peer
+//
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// px.Status() return values, indicating whether an agreement has been
+// decided, or Paxos has not yet reached agreement, or it was agreed but
+// forgotten (i.e. < Min()).
+type Fate int
+
+const (
+	Decided   Fate = iota + 1
+	Pending        // not yet decided.
+	Forgotten      // decided but forgotten.
+)
+
+type Paxos struct {
+	mu    sync.Mutex
+	l     net.Listener
+	dead  int32 // for testing
+	peers []string
+	me    int // index into peers[]
+	impl  PaxosImpl
+}
+
+// tell the peer to shut itself down.
+func (px *Paxos) Kill() {
+	atomic.StoreInt32(&px.dead, 1)
+	if px.l != nil {
+		px.l.Close()
+	}
+}
+
+func (px *Paxos) isdead() bool {
+	return atomic.LoadInt32(&px.dead) != 0
+}
+
+// the application wants to create a paxos peer. the ports of all the
+// paxos peers (including this one) are in peers[]. this server's port
+// is peers[me]. if rpcs is nil, the peer listens on peers[me] itself.
+func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+	px := &Paxos{}
+	px.peers = peers
+	px.me = me
+	px.initImpl()
+
+	if rpcs != nil {
+		// caller will create socket &c
+		rpcs.Register(px)
+		return px
+	}
+	rpcs = rpc.NewServer()
+	rpcs.Register(px)
+
+	os.Remove(peers[me]) // only needed for "unix"
+	l, e := net.Listen("unix", peers[me])
+	if e != nil {
+		log.Fatal("listen error: ", e)
+	}
+	px.l = l
+
+	go func() {
+		for !px.isdead() {
+			conn, err := px.l.Accept()
+			if err == nil && !px.isdead() {
+				go rpcs.ServeConn(conn)
+			} else if err == nil {
+				conn.Close()
+			}
+		}
+	}()
+	return px
+}
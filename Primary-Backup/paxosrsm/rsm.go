@@ -0,0 +1,28 @@
+package paxosrsm
+
+//
+// the parts of proj3's paxosrsm package that are not in server_impl.go:
+// a replicated state machine that puts each op through a Paxos log and
+// hands the decided ops, in order, to applyOp.
+//
+
+import (
+	"sync"
+
+	"proj2/paxos"
+)
+
+type PaxosRSM struct {
+	mu      sync.Mutex
+	me      int
+	px      *paxos.Paxos
+	applyOp func(interface{})
+	impl    PaxosRSMImpl
+}
+
+// make a state machine over px; applyOp is called with each decided op.
+func MakeRSM(me int, px *paxos.Paxos, applyOp func(interface{})) *PaxosRSM {
+	rsm := &PaxosRSM{me: me, px: px, applyOp: applyOp}
+	rsm.InitRSMImpl()
+	return rsm
+}
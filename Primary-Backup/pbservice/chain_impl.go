@@ -0,0 +1,256 @@
+package pbservice
+
+import (
+	"time"
+
+	"proj2/viewservice"
+)
+
+// in chain replication mode the primary and the backups of a view form
+// a chain, in order. writes enter at the head (the primary) and go
+// down the chain; a write is done once the tail has it. Gets go to the
+// tail, which has only writes every server has. each server applies
+// the writes it gets and keeps those the tail does not have yet in a
+// log, which a forwarder sends down the chain in batches, so that many
+// writes are in flight at once. on a view change the head sends its
+// whole state to the others, as to a new backup in primary/backup
+// mode, and every log starts over once they all have it.
+
+// like StartServer, in chain replication mode. every server of the
+// service must be started this way, and clerks made with
+// MakeChainClerk.
+func StartChainServer(vshost string, me string) *PBServer {
+	return startServerWithConf(vshost, me, serverConf{chain: true})
+}
+
+// like MakeClerk, for servers in chain replication mode.
+func MakeChainClerk(vshost string, me string) *Clerk {
+	ck := MakeClerk(vshost, me)
+	ck.impl.chain = true
+	return ck
+}
+
+// the last server of the chain in the current view. the clerk keeps
+// it until the tail stops answering Gets, as it does the primary.
+func (ck *Clerk) tail() string {
+	if ck.impl.tail != UNASSIGNED {
+		return ck.impl.tail
+	}
+	view, ok := ck.viewservice().GetFull()
+	for !ok {
+		time.Sleep(viewservice.PingInterval)
+		view, ok = ck.viewservice().GetFull()
+	}
+	ck.impl.tail = view.Primary
+	if len(view.Backups) > 0 {
+		ck.impl.tail = view.Backups[len(view.Backups)-1]
+	}
+	return ck.impl.tail
+}
+
+// called by initImpl.
+func (pb *PBServer) initChain() {
+	pb.impl.chain = true
+	pb.impl.chainPending = make(map[int64]int)
+	go pb.forwardChain()
+}
+
+// the server after this one in the chain, or UNASSIGNED at the tail.
+func (pb *PBServer) successor() string {
+	chain := append([]string{pb.impl.view.Primary}, pb.impl.view.Backups...)
+	for i := 0; i < len(chain)-1; i++ {
+		if chain[i] == pb.me {
+			return chain[i+1]
+		}
+	}
+	return UNASSIGNED
+}
+
+// the server before this one in the chain, or UNASSIGNED at the head.
+func (pb *PBServer) predecessor() string {
+	chain := append([]string{pb.impl.view.Primary}, pb.impl.view.Backups...)
+	for i := 1; i < len(chain); i++ {
+		if chain[i] == pb.me {
+			return chain[i-1]
+		}
+	}
+	return UNASSIGNED
+}
+
+func (pb *PBServer) isTail() bool {
+	chain := append([]string{pb.impl.view.Primary}, pb.impl.view.Backups...)
+	return chain[len(chain)-1] == pb.me
+}
+
+// whether this server has the head's database for its view.
+func (pb *PBServer) chainReady() bool {
+	return pb.impl.view.Viewnum != 0 && pb.impl.chainView == pb.impl.view.Viewnum
+}
+
+// how many ops of the view's log this server has applied.
+func (pb *PBServer) chainEnd() int {
+	return pb.impl.chainAcked + len(pb.impl.chainLog)
+}
+
+// the server has the head's database for its view: start the log over.
+// every pending write of the head is in that database, so it is done.
+func (pb *PBServer) resetChain() {
+	pb.impl.chainView = pb.impl.view.Viewnum
+	pb.impl.chainLog = nil
+	pb.impl.chainAcked = 0
+	pb.impl.chainPending = make(map[int64]int)
+	pb.impl.chainEpoch++
+	pb.impl.cond.Broadcast()
+}
+
+// append op, already applied, to the log.
+func (pb *PBServer) logChain(op PutAppendArgs) {
+	pb.impl.chainLog = append(pb.impl.chainLog, op)
+	if pb.isTail() {
+		pb.ackChain(pb.chainEnd())
+	}
+	pb.impl.cond.Broadcast()
+}
+
+// the tail has the first acked ops of the log.
+func (pb *PBServer) ackChain(acked int) {
+	if acked <= pb.impl.chainAcked {
+		return
+	}
+	n := acked - pb.impl.chainAcked
+	for _, op := range pb.impl.chainLog[:n] {
+		delete(pb.impl.chainPending, op.Impl.Client)
+	}
+	pb.impl.chainLog = pb.impl.chainLog[n:]
+	pb.impl.chainAcked = acked
+	pb.impl.cond.Broadcast()
+}
+
+// PutAppend at the head: apply the op, and wait until the tail has it.
+func (pb *PBServer) chainPutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
+	pb.impl.muGlobal.Lock()
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	if !pb.isPrimary() || !pb.chainReady() {
+		pb.impl.muGlobal.Unlock()
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	seq, pending := pb.impl.chainPending[args.Impl.Client]
+	if !pending && pb.isApplied(args.Impl) {
+		pb.impl.muGlobal.Unlock()
+		*reply = pb.impl.clients[args.Impl.Client].Reply
+		return nil
+	}
+	if !pending {
+		pb.doPutAppend(*args)
+		seq = pb.chainEnd()
+		pb.impl.chainPending[args.Impl.Client] = seq
+		pb.logChain(*args)
+	}
+	pb.impl.muGlobal.Unlock()
+
+	epoch := pb.impl.chainEpoch
+	for pb.impl.chainAcked <= seq && pb.impl.chainEpoch == epoch && pb.isPrimary() && !pb.isdead() {
+		pb.wait(viewservice.PingInterval)
+	}
+	if !pb.isPrimary() || pb.isdead() {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Get at the tail. the tail checks with the server before it that its
+// view is still current, as the primary does with the backup in
+// primary/backup mode, but without holding its locks meanwhile: the
+// head may be sending it pages of its state.
+func (pb *PBServer) chainGet(args *GetArgs, reply *GetReply) error {
+	pb.impl.muGlobal.Lock()
+	pb.impl.muView.Lock()
+	ready := pb.isTail() && pb.chainReady()
+	view, predecessor := pb.impl.view.View, pb.predecessor()
+	val, ok := pb.impl.database[args.Key]
+	pb.impl.muView.Unlock()
+	pb.impl.muGlobal.Unlock()
+	if !ready {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	if predecessor != UNASSIGNED {
+		syncArgs, syncReply := SyncGetArg{view}, SyncGetReply{}
+		if !call(predecessor, "PBServer.SyncGet", &syncArgs, &syncReply) || !syncReply.Ok {
+			reply.Err = ErrWrongServer
+			return nil
+		}
+	}
+	if !ok {
+		reply.Err = ErrNoKey
+		return nil
+	}
+	reply.Value = val
+	reply.Err = OK
+	return nil
+}
+
+// ChainForward RPC handler: the server before this one in the chain
+// sends the ops of the log from position From. they are applied and
+// logged unless this server has them already, and the reply says how
+// many ops the tail has, waiting up to a PingInterval for the tail to
+// get these ones.
+func (pb *PBServer) ChainForward(args *ChainForwardArgs, reply *ChainForwardReply) error {
+	pb.impl.muGlobal.Lock()
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	if args.View.Viewnum != pb.impl.view.Viewnum || !pb.chainReady() || args.From > pb.chainEnd() {
+		pb.impl.muGlobal.Unlock()
+		reply.Ok = false
+		return nil
+	}
+	for i := pb.chainEnd() - args.From; i < len(args.Ops); i++ {
+		pb.doPutAppend(args.Ops[i])
+		pb.logChain(args.Ops[i])
+	}
+	pb.impl.muGlobal.Unlock()
+
+	epoch, end := pb.impl.chainEpoch, args.From+len(args.Ops)
+	deadline := time.Now().Add(viewservice.PingInterval)
+	for pb.impl.chainAcked < end && pb.impl.chainEpoch == epoch && time.Now().Before(deadline) {
+		pb.wait(time.Until(deadline))
+	}
+	if pb.impl.chainEpoch != epoch {
+		reply.Ok = false
+		return nil
+	}
+	reply.Ok = true
+	reply.Acked = pb.impl.chainAcked
+	return nil
+}
+
+// send the ops in the log that the tail does not have down the chain,
+// for as long as the server runs.
+func (pb *PBServer) forwardChain() {
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	for !pb.isdead() {
+		next := pb.successor()
+		if next == UNASSIGNED || !pb.chainReady() || len(pb.impl.chainLog) == 0 {
+			pb.wait(viewservice.PingInterval)
+			continue
+		}
+		args := ChainForwardArgs{pb.impl.view.View, pb.impl.chainAcked,
+			append([]PutAppendArgs{}, pb.impl.chainLog...)}
+		var reply ChainForwardReply
+		epoch := pb.impl.chainEpoch
+		pb.impl.muView.Unlock()
+		ok := call(next, "PBServer.ChainForward", &args, &reply)
+		if !ok || !reply.Ok {
+			time.Sleep(viewservice.PingInterval)
+		}
+		pb.impl.muView.Lock()
+		if ok && reply.Ok && pb.impl.chainEpoch == epoch {
+			pb.ackChain(reply.Acked)
+		}
+	}
+}
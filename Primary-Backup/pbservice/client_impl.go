@@ -11,11 +11,18 @@ const UNASSIGNED string = ""
 // additions to Clerk state.
 type ClerkImpl struct {
 	primary string
+	vs      viewClerk // if not ck.vs
+	chain   bool      // Gets go to the tail of the chain
+	tail    string    // of the chain, like primary
+	client  int64
+	seq     int64 // of the last PutAppend
 }
 
 // your ck.impl.* initializations here.
 func (ck *Clerk) initImpl() {
 	ck.impl.primary = UNASSIGNED
+	ck.impl.tail = UNASSIGNED
+	ck.impl.client = nrand()
 }
 
 // fetch a key's value from the current primary;
@@ -26,12 +33,20 @@ func (ck *Clerk) initImpl() {
 func (ck *Clerk) Get(key string) string {
 	for {
 		ck.UpdatePrimaryIfNeeded()
+		server := ck.impl.primary
+		if ck.impl.chain {
+			server = ck.tail()
+		}
 		//log.Printf("key %v", key)
 		getArg, getReply := GetArgs{key, GetArgsImpl{}}, GetReply{}
-		ok := call(ck.impl.primary, "PBServer.Get", &getArg, &getReply)
+		ok := call(server, "PBServer.Get", &getArg, &getReply)
 		//log.Printf("ok %v, reply %v", ok, getReply)
 		if !ok || getReply.Err == ErrWrongServer {
 			ck.impl.primary = UNASSIGNED
+			if ck.impl.chain {
+				ck.impl.tail = UNASSIGNED
+				time.Sleep(viewservice.PingInterval)
+			}
 			continue
 		}
 		if getReply.Err == ErrNoKey {
@@ -43,11 +58,14 @@ func (ck *Clerk) Get(key string) string {
 
 // send a Put() or Append() RPC
 // must keep trying until it succeeds.
+// a clerk sends one request at a time, so it must not be used by
+// several goroutines at once.
 func (ck *Clerk) PutAppend(key string, value string, op string) {
-	id := nrand()
+	ck.impl.seq++
 	for {
 		ck.UpdatePrimaryIfNeeded()
-		putAppendArg, putAppendReply := PutAppendArgs{key, value, PutAppendArgsImpl{op, id}}, PutAppendReply{}
+		putAppendArg := PutAppendArgs{key, value, PutAppendArgsImpl{op, ck.impl.client, ck.impl.seq}}
+		putAppendReply := PutAppendReply{}
 		ok := call(ck.impl.primary, "PBServer.PutAppend", &putAppendArg, &putAppendReply)
 		if ok && putAppendReply.Err == OK {
 			break
@@ -62,9 +80,9 @@ func (ck *Clerk) UpdatePrimaryIfNeeded() {
 	if ck.impl.primary != UNASSIGNED {
 		return
 	}
-	view, ok := ck.vs.Get()
+	view, ok := ck.viewservice().Get()
 	for !ok {
-		view, ok = ck.vs.Get()
+		view, ok = ck.viewservice().Get()
 		time.Sleep(viewservice.PingInterval)
 	}
 	ck.impl.primary = view.Primary
@@ -0,0 +1,200 @@
+package pbservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"proj2/common"
+)
+
+// in durable mode a server keeps its state in a directory, so that it
+// survives a crash of every server at once. every change to the state,
+// a PutAppend or a page of a transfer, is appended to a write-ahead
+// log and synced before the server replies; every SnapshotRecords
+// records the whole state is written to a snapshot and the log starts
+// over. a restarted server loads the snapshot, replays the log, and
+// rejoins with its data: as a backup, it only gets the buckets of keys
+// that changed meanwhile (see DigestBuckets); after all servers failed,
+// it may become primary with it, which is why it also keeps the view it
+// last acked and pings with that after a restart.
+const SnapshotRecords = 1000
+
+type walRecord struct {
+	Lsn  int64
+	Op   *PutAppendArgs `json:",omitempty"`
+	Page *SyncPageArg   `json:",omitempty"`
+}
+
+type durableSnapshot struct {
+	Lsn      int64 // of the last record in it
+	Database map[string]string
+	Clients  map[int64]ClientRecord
+	Session  int64
+	NextPage int
+}
+
+// like StartServer, keeping the server's state in dir, which is
+// created if need be. a server restarted with the same dir carries on
+// with the state it had.
+func StartDurableServer(vshost string, me string, dir string) *PBServer {
+	return startServerWithConf(vshost, me, serverConf{dir: dir})
+}
+
+// called by initImpl: load the state kept in dir.
+func (pb *PBServer) initDurable(dir string) {
+	pb.impl.dir = dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal("cannot create ", dir, ": ", err)
+	}
+	if err := pb.loadSnapshot(); err != nil {
+		log.Fatal("cannot load snapshot: ", err)
+	}
+	if err := pb.replayLog(); err != nil {
+		log.Fatal("cannot replay log: ", err)
+	}
+	if b, err := os.ReadFile(pb.viewName()); err == nil {
+		json.Unmarshal(b, &pb.impl.pingnum)
+	}
+	wal, err := os.OpenFile(pb.walName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal("cannot open log: ", err)
+	}
+	pb.impl.wal = wal
+}
+
+func (pb *PBServer) walName() string {
+	return filepath.Join(pb.impl.dir, "wal")
+}
+
+func (pb *PBServer) snapshotName() string {
+	return filepath.Join(pb.impl.dir, "snapshot")
+}
+
+func (pb *PBServer) viewName() string {
+	return filepath.Join(pb.impl.dir, "view")
+}
+
+// the server acks view viewnum from now on. muView must be held.
+func (pb *PBServer) setPingnum(viewnum uint) {
+	if pb.impl.pingnum == viewnum {
+		return
+	}
+	pb.impl.pingnum = viewnum
+	if pb.impl.dir == "" {
+		return
+	}
+	b, _ := json.Marshal(viewnum)
+	if err := common.WriteFileAtomic(pb.viewName(), b); err != nil {
+		fmt.Println("cannot save view:", err)
+	}
+}
+
+func (pb *PBServer) loadSnapshot() error {
+	b, err := os.ReadFile(pb.snapshotName())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snap durableSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+	for k, v := range snap.Database {
+		pb.setValue(k, v)
+	}
+	for c, r := range snap.Clients {
+		pb.impl.clients[c] = r
+	}
+	pb.impl.session, pb.impl.nextPage = snap.Session, snap.NextPage
+	pb.impl.lsn = snap.Lsn
+	return nil
+}
+
+// apply the records logged after the snapshot. a crash may have torn
+// the last one, which was never replied to; it is dropped.
+func (pb *PBServer) replayLog() error {
+	b, err := os.ReadFile(pb.walName())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	end := bytes.LastIndexByte(b, '\n') + 1
+	if end < len(b) {
+		if err := os.Truncate(pb.walName(), int64(end)); err != nil {
+			return err
+		}
+	}
+	for _, line := range bytes.Split(b[:end], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		// the log may not have been emptied after the last snapshot.
+		if rec.Lsn <= pb.impl.lsn {
+			continue
+		}
+		if rec.Op != nil {
+			pb.applyPutAppend(*rec.Op)
+		} else if rec.Page != nil {
+			pb.applyPage(rec.Page)
+		}
+		pb.impl.lsn = rec.Lsn
+		pb.impl.walRecords++
+	}
+	return nil
+}
+
+// append a change, already applied, to the log, in durable mode. a
+// server that cannot keep its state stops. muGlobal must be held.
+func (pb *PBServer) logRecord(rec walRecord) {
+	if pb.impl.wal == nil {
+		return
+	}
+	pb.impl.lsn++
+	rec.Lsn = pb.impl.lsn
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		log.Fatal("cannot encode log record: ", err)
+	}
+	if _, err := pb.impl.wal.Write(append(b, '\n')); err != nil {
+		log.Fatal("cannot write log: ", err)
+	}
+	if err := pb.impl.wal.Sync(); err != nil {
+		log.Fatal("cannot sync log: ", err)
+	}
+	pb.impl.walRecords++
+	if pb.impl.walRecords >= SnapshotRecords {
+		if err := pb.snapshot(); err != nil {
+			fmt.Println("cannot snapshot, keeping the log:", err)
+		}
+	}
+}
+
+// write the whole state to the snapshot, atomically, and empty the log.
+// muGlobal must be held.
+func (pb *PBServer) snapshot() error {
+	snap := durableSnapshot{pb.impl.lsn, pb.impl.database, pb.impl.clients,
+		pb.impl.session, pb.impl.nextPage}
+	b, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+	// the snapshot is durable once this returns, so the log can go.
+	if err := common.WriteFileAtomic(pb.snapshotName(), b); err != nil {
+		return err
+	}
+	if err := pb.impl.wal.Truncate(0); err != nil {
+		return err
+	}
+	pb.impl.walRecords = 0
+	return nil
+}
@@ -0,0 +1,131 @@
+package pbservice
+
+import (
+	"sync"
+	"time"
+
+	"proj2/viewservice"
+)
+
+// the primary applies PutAppends as they come and queues them on
+// forwardLog; forwardOps sends whatever has queued up to every backup
+// in one SyncPutAppend, while later ops keep queuing for the next one.
+// a client hears back once the backups have everything applied before
+// its reply, and a Get waits the same way before it returns a value.
+
+// queue an op the primary has applied. muView must be held.
+func (pb *PBServer) queueForward(args PutAppendArgs) {
+	pb.impl.forwardLog = append(pb.impl.forwardLog, args)
+	pb.impl.cond.Broadcast()
+}
+
+// the number of ops forwarded once the backups have everything
+// applied so far, and the epoch to wait in. muView must be held.
+func (pb *PBServer) forwardMark() (int, int) {
+	return pb.impl.forwarded + len(pb.impl.forwardLog), pb.impl.forwardEpoch
+}
+
+// the first n of forwardLog have reached every backup. muView must be
+// held.
+func (pb *PBServer) ackForward(n int) {
+	pb.impl.forwardLog = pb.impl.forwardLog[n:]
+	pb.impl.forwarded += n
+	pb.impl.cond.Broadcast()
+}
+
+// this server is no longer primary: whoever waits for its ops fails.
+// the dropped ops stay applied here; see PutAppend for why that is
+// safe. muView must be held.
+func (pb *PBServer) dropForward() {
+	pb.impl.forwarded += len(pb.impl.forwardLog)
+	pb.impl.forwardLog = nil
+	pb.impl.forwardEpoch++
+	pb.impl.cond.Broadcast()
+}
+
+// wait until n ops have been forwarded; false if this server stops
+// being the primary first. muView must be held, and is released while
+// waiting.
+func (pb *PBServer) waitForwarded(n int, epoch int) bool {
+	for pb.impl.forwarded < n && pb.impl.forwardEpoch == epoch && pb.isPrimary() && !pb.isdead() {
+		pb.wait(viewservice.PingInterval)
+	}
+	return pb.impl.forwarded >= n && pb.impl.forwardEpoch == epoch && pb.isPrimary() && !pb.isdead()
+}
+
+// send the queued ops to the backups, a batch at a time, for as long as
+// the server runs. a batch is done once every live backup has it; a
+// backup still being brought up to date gets the ops with the rest of
+// the state.
+func (pb *PBServer) forwardOps() {
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	sent := make(map[string]bool) // backups that have the current batch
+	for !pb.isdead() {
+		if !pb.isPrimary() || len(pb.impl.forwardLog) == 0 {
+			pb.wait(viewservice.PingInterval)
+			continue
+		}
+		ops := append([]PutAppendArgs{}, pb.impl.forwardLog...)
+		view, epoch := pb.impl.view.View, pb.impl.forwardEpoch
+		sessions := make(map[string]int64)
+		for _, backup := range pb.impl.view.Backups {
+			if st := pb.impl.backups[backup]; st != nil && st.live && !sent[backup] {
+				sessions[backup] = st.session
+			}
+		}
+		pb.impl.muView.Unlock()
+		replies := pb.sendOps(view, ops, sessions)
+		pb.impl.muView.Lock()
+		if pb.impl.forwardEpoch != epoch {
+			sent = make(map[string]bool)
+			continue
+		}
+		done := true
+		for _, backup := range pb.impl.view.Backups {
+			st := pb.impl.backups[backup]
+			if sent[backup] || st == nil || !st.live {
+				continue
+			}
+			reply, ok := replies[backup]
+			if ok && reply.Ok && st.session == sessions[backup] {
+				sent[backup] = true
+			} else if ok && reply.Lost && st.session == sessions[backup] {
+				pb.resetBackup(backup)
+			} else {
+				done = false
+			}
+		}
+		if done {
+			pb.ackForward(len(ops))
+			sent = make(map[string]bool)
+			continue
+		}
+		pb.impl.muView.Unlock()
+		time.Sleep(viewservice.PingInterval)
+		pb.impl.muView.Lock()
+	}
+}
+
+// send ops to each of the backups in sessions at once; the replies of
+// those that answered.
+func (pb *PBServer) sendOps(view viewservice.View, ops []PutAppendArgs,
+	sessions map[string]int64) map[string]SyncPutAppendReply {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	replies := make(map[string]SyncPutAppendReply)
+	for backup, session := range sessions {
+		wg.Add(1)
+		go func(backup string, session int64) {
+			defer wg.Done()
+			args, reply := SyncPutAppendArg{view, ops, session}, SyncPutAppendReply{}
+			if call(backup, "PBServer.SyncPutAppend", &args, &reply) {
+				mu.Lock()
+				replies[backup] = reply
+				mu.Unlock()
+			}
+		}(backup, session)
+	}
+	wg.Wait()
+	return replies
+}
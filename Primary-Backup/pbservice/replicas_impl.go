@@ -0,0 +1,46 @@
+package pbservice
+
+import (
+	"time"
+
+	"proj2/viewservice"
+)
+
+// the viewservice as servers and clerks use it: a single viewserver or
+// a replicated one.
+type viewClerk interface {
+	PingLease(viewnum uint) (viewservice.FullView, time.Duration, error)
+	Get() (viewservice.View, bool)
+	GetFull() (viewservice.FullView, bool)
+}
+
+// like StartServer, for a viewservice replicated at vshosts.
+func StartServerWithReplicas(vshosts []string, me string) *PBServer {
+	pb := StartServer(vshosts[0], me)
+	pb.impl.muView.Lock()
+	pb.impl.vs = viewservice.MakeReplicatedClerk(me, vshosts)
+	pb.impl.muView.Unlock()
+	return pb
+}
+
+// like MakeClerk, for a viewservice replicated at vshosts.
+func MakeClerkWithReplicas(vshosts []string, me string) *Clerk {
+	ck := MakeClerk(vshosts[0], me)
+	ck.impl.vs = viewservice.MakeReplicatedClerk(me, vshosts)
+	return ck
+}
+
+// pb.impl.muView must be held.
+func (pb *PBServer) viewservice() viewClerk {
+	if pb.impl.vs != nil {
+		return pb.impl.vs
+	}
+	return pb.vs
+}
+
+func (ck *Clerk) viewservice() viewClerk {
+	if ck.impl.vs != nil {
+		return ck.impl.vs
+	}
+	return ck.vs
+}
@@ -6,9 +6,17 @@ import "proj2/viewservice"
 // must start with capital letters, otherwise RPC will break.
 
 // additional state to include in arguments to PutAppend RPC.
+// a clerk numbers its requests 1, 2, ...
 type PutAppendArgsImpl struct {
-	Op string
-	Id int64
+	Op     string
+	Client int64
+	Seq    int64
+}
+
+// the latest request of a client a server applied, and its reply.
+type ClientRecord struct {
+	Seq   int64
+	Reply PutAppendReply
 }
 
 // additional state to include in arguments to Get RPC.
@@ -19,14 +27,28 @@ type GetArgsImpl struct {
 // for new RPCs that you add, declare types for arguments and reply.
 //
 
-type SyncDBArg struct {
-	View            viewservice.View
-	Database        map[string]string
-	AppliedRequests map[int64]bool
+type SyncPageArg struct {
+	View     viewservice.View
+	Session  int64
+	Seq      int
+	Stale    []int // buckets to empty first, in the first page
+	Database map[string]string
+	Clients  map[int64]ClientRecord
+	Last     bool // the backup is complete for View
 }
 
-type SyncReply struct {
-	Ok bool
+type SyncPageReply struct {
+	Ok   bool
+	Lost bool // the backup does not know the session
+}
+
+type SyncDigestArg struct {
+	View viewservice.View
+}
+
+type SyncDigestReply struct {
+	Ok      bool
+	Digests []uint64
 }
 
 type SyncGetArg struct {
@@ -37,11 +59,25 @@ type SyncGetReply struct {
 	Ok bool
 }
 
+// a batch of the primary's ops, in the order it applied them.
 type SyncPutAppendArg struct {
-	View viewservice.View
-	Args PutAppendArgs
+	View    viewservice.View
+	Ops     []PutAppendArgs
+	Session int64
 }
 
 type SyncPutAppendReply struct {
-	Ok bool
+	Ok   bool
+	Lost bool // the backup does not know the session
+}
+
+type ChainForwardArgs struct {
+	View viewservice.View
+	From int // position of Ops[0] in the view's chain log
+	Ops  []PutAppendArgs
+}
+
+type ChainForwardReply struct {
+	Ok    bool
+	Acked int // how many ops of the log the tail has
 }
@@ -1,6 +1,7 @@
 package pbservice
 
 import (
+	"os"
 	"sync"
 	"time"
 
@@ -10,40 +11,125 @@ import (
 // additions to PBServer state.
 // errorpb
 type PBServerImpl struct {
-	database        map[string]string
-	appliedRequests map[int64]bool
-	view            viewservice.View
-	muGlobal        sync.Mutex
-	muView          sync.Mutex
+	database map[string]string
+	clients  map[int64]ClientRecord
+	digests  []uint64 // of the database, per bucket of keys
+	view     viewservice.FullView
+	vs       viewClerk // if not pb.vs
+	muGlobal sync.Mutex
+	muView   sync.Mutex
+	pingnum  uint       // the view to ack
+	leaseEnd time.Time  // Gets need not ask the backup until then
+	cond     *sync.Cond // on muView, for ops getting to the backups
+
+	// the primary's ops that not every backup has yet, guarded by
+	// muView; see forward_impl.go.
+	forwardLog   []PutAppendArgs
+	forwarded    int // ops forwarded before forwardLog
+	forwardEpoch int // bumped whenever forwardLog is dropped
+
+	// state transfer. a backup knows the session it got pages from; the
+	// primary keeps a backupImpl per backup.
+	session  int64
+	nextPage int
+	backups  map[string]*backupImpl
+
+	// chain replication mode, guarded by muView.
+	chain        bool
+	chainView    uint // the view whose database this server has
+	chainLog     []PutAppendArgs
+	chainAcked   int           // ops of the view the tail has, before chainLog
+	chainPending map[int64]int // clients of the head's ops in chainLog, and where
+	chainEpoch   int           // bumped whenever the log starts over
+
+	// durable mode, see durable_impl.go.
+	wal        *os.File
+	lsn        int64 // of the last record logged
+	walRecords int   // logged since the last snapshot
+	dir        string
+}
+
+// how a server is to run, for the variants of StartServer: they leave
+// it here for initImpl, since StartServer takes no options.
+type serverConf struct {
+	chain bool   // chain replication
+	dir   string // where to keep the server's state, if durable
+}
+
+var serverConfs = make(map[string]serverConf)
+var muServerConfs sync.Mutex
+
+func startServerWithConf(vshost string, me string, conf serverConf) *PBServer {
+	muServerConfs.Lock()
+	serverConfs[me] = conf
+	muServerConfs.Unlock()
+	return StartServer(vshost, me)
+}
+
+func takeServerConf(me string) serverConf {
+	muServerConfs.Lock()
+	defer muServerConfs.Unlock()
+	conf := serverConfs[me]
+	delete(serverConfs, me)
+	return conf
 }
 
 // your pb.impl.* initializations here.
 func (pb *PBServer) initImpl() {
 	pb.impl.database = make(map[string]string)
-	pb.impl.appliedRequests = make(map[int64]bool)
-	pb.impl.view = viewservice.View{0, UNASSIGNED, UNASSIGNED}
+	pb.impl.clients = make(map[int64]ClientRecord)
+	pb.impl.view = viewservice.FullView{View: viewservice.View{0, UNASSIGNED, UNASSIGNED}}
+	pb.impl.backups = make(map[string]*backupImpl)
+	pb.impl.digests = make([]uint64, DigestBuckets)
+	pb.impl.cond = sync.NewCond(&pb.impl.muView)
+	conf := takeServerConf(pb.me)
+	if conf.chain {
+		pb.initChain()
+	} else {
+		go pb.forwardOps()
+	}
+	if conf.dir != "" {
+		pb.initDurable(conf.dir)
+	}
 }
 
-// server Get() RPC handler.
+// the primary gives up its lease this much early, in case its clock
+// runs fast.
+const leaseMargin = viewservice.PingInterval / 2
+
+// server Get() RPC handler. the value may include writes the backups
+// do not have yet, so it is only returned once they do. while the
+// primary holds a lease from the viewservice, no other server can
+// become primary, so it can reply on its own; otherwise it checks with
+// the backup that its view is still current.
 func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
+	if pb.impl.chain {
+		return pb.chainGet(args, reply)
+	}
 	pb.impl.muGlobal.Lock()
-	defer pb.impl.muGlobal.Unlock()
 	pb.impl.muView.Lock()
 	defer pb.impl.muView.Unlock()
 	if !pb.isPrimary() {
+		pb.impl.muGlobal.Unlock()
 		reply.Err = ErrWrongServer
 		return nil
 	}
-	if pb.hasBackup() {
-		syncArgs, syncReply := SyncGetArg{pb.impl.view}, SyncGetReply{}
+	val, found := pb.impl.database[args.Key]
+	n, epoch := pb.forwardMark()
+	pb.impl.muGlobal.Unlock()
+	if !pb.waitForwarded(n, epoch) {
+		reply.Err = ErrWrongServer
+		return nil
+	}
+	if pb.hasBackup() && !time.Now().Before(pb.impl.leaseEnd) {
+		syncArgs, syncReply := SyncGetArg{pb.impl.view.View}, SyncGetReply{}
 		ok := call(pb.getBackup(), "PBServer.SyncGet", &syncArgs, &syncReply)
 		if !ok || !syncReply.Ok {
 			reply.Err = ErrWrongServer
 			return nil
 		}
 	}
-	val, ok := pb.impl.database[args.Key]
-	if !ok {
+	if !found {
 		reply.Err = ErrNoKey
 		return nil
 	}
@@ -53,36 +139,44 @@ func (pb *PBServer) Get(args *GetArgs, reply *GetReply) error {
 	return nil
 }
 
-// server PutAppend() RPC handler.
+// server PutAppend() RPC handler. the op is applied at once and queued
+// for the backups, and the reply waits until they have it along with
+// everything applied before it. a duplicate waits the same way, since
+// the original may not have reached the backups yet.
+//
+// if this server stops being primary first, the client gets
+// ErrWrongServer for an op that is in this server's database and
+// duplicate table but maybe not the new primary's. that state is never
+// read: a Get only replies once every op applied before it has been
+// forwarded, and this server refuses Gets once it is no longer primary.
+// it becomes primary again only after a new primary has brought it up
+// to date as a backup, which replaces the buckets and client records
+// that differ (see sendSnapshot), or through handleRejoin in the
+// viewservice, when no other server has newer state; then the client's
+// retry finds its op applied, as it would have if forwarding had worked.
 func (pb *PBServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error {
+	if pb.impl.chain {
+		return pb.chainPutAppend(args, reply)
+	}
 	pb.impl.muGlobal.Lock()
-	defer pb.impl.muGlobal.Unlock()
 	pb.impl.muView.Lock()
 	defer pb.impl.muView.Unlock()
 	if !pb.isPrimary() {
+		pb.impl.muGlobal.Unlock()
 		reply.Err = ErrWrongServer
 		return nil
 	}
-	if pb.isApplied(args.Impl.Id) {
-		reply.Err = OK
-		return nil
+	if !pb.isApplied(args.Impl) {
+		pb.doPutAppend(*args)
+		pb.queueForward(*args)
 	}
-	pb.doPutAppend(*args)
-	if pb.hasBackup() {
-		syncArgs, syncReply := SyncPutAppendArg{pb.impl.view, *args}, SyncPutAppendReply{}
-		//log.Printf("*** sync arg %v", syncArgs)
-		ok := call(pb.getBackup(), "PBServer.SyncPutAppend", &syncArgs, &syncReply)
-		for !ok || !syncReply.Ok {
-			pb.impl.muView.Unlock()
-			time.Sleep(viewservice.PingInterval)
-			pb.impl.muView.Lock()
-			if pb.hasBackup() {
-				syncArgs, syncReply = SyncPutAppendArg{pb.impl.view, *args}, SyncPutAppendReply{}
-				ok = call(pb.getBackup(), "PBServer.SyncPutAppend", &syncArgs, &syncReply)
-			}
-		}
+	*reply = pb.impl.clients[args.Impl.Client].Reply
+	n, epoch := pb.forwardMark()
+	pb.impl.muGlobal.Unlock()
+	if !pb.waitForwarded(n, epoch) {
+		reply.Err = ErrWrongServer
+		return nil
 	}
-	reply.Err = OK
 	return nil
 }
 
@@ -94,45 +188,58 @@ func (pb *PBServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) error
 func (pb *PBServer) tick() {
 	pb.impl.muView.Lock()
 	defer pb.impl.muView.Unlock()
-	currView, ok := pb.vs.Ping(pb.impl.view.Viewnum)
+	sent := time.Now()
+	currView, lease, ok := pb.viewservice().PingLease(pb.impl.pingnum)
 	// log.Printf("%v ticking, myView %v, received view %v", pb.me, pb.impl.view, currView)
 	if ok != nil {
 		return
 	}
 	viewChange := pb.viewChanged(&currView, &pb.impl.view)
 	if !viewChange {
+		if lease > 0 && pb.isPrimary() {
+			pb.impl.leaseEnd = sent.Add(lease - leaseMargin)
+		}
 		return
 	}
-	oldView := pb.impl.view
 	pb.impl.view = currView
+	pb.impl.leaseEnd = time.Time{}
 	if !pb.isPrimary() {
+		pb.impl.backups = make(map[string]*backupImpl)
+		pb.dropForward()
+		pb.setPingnum(currView.Viewnum)
 		return
 	}
-	// now we are primary and should sync with the backup if it exists
-	if pb.hasBackup() {
-		syncArgs, syncReply := SyncDBArg{pb.impl.view, pb.impl.database, pb.impl.appliedRequests}, SyncReply{}
-		// log.Printf("primary sync args %v", syncArgs)
-		ok := call(pb.getBackup(), "PBServer.SyncDB", &syncArgs, &syncReply)
-		if !ok || !syncReply.Ok {
-			pb.impl.view = oldView
-			// log.Printf("primary synced failed, view %v", pb.impl.view)
-		} else {
-			pb.vs.Ping(pb.impl.view.Viewnum)
-			// log.Printf("primary synced succeeded, view %v", pb.impl.view)
-		}
-	}
+	// now we are primary and should bring the backups up to date; the
+	// view is acked once they all are.
+	pb.startTransfers()
 	//log.Printf("@@@ %v", pb)
 }
 
 func (pb *PBServer) doPutAppend(args PutAppendArgs) {
-	key, value, op, id := args.Key, args.Value, args.Impl.Op, args.Impl.Id
+	pb.applyPutAppend(args)
+	pb.logRecord(walRecord{Op: &args})
+	pb.markDirty(args.Key, args.Impl.Client)
+}
+
+func (pb *PBServer) applyPutAppend(args PutAppendArgs) {
+	key, value, op := args.Key, args.Value, args.Impl.Op
 	if op == "Put" {
-		pb.impl.database[key] = value
+		pb.setValue(key, value)
 	} else if op == "Append" {
-		pb.impl.database[key] += value
+		pb.setValue(key, pb.impl.database[key]+value)
 	}
-	pb.impl.appliedRequests[id] = true
+	pb.impl.clients[args.Impl.Client] = ClientRecord{args.Impl.Seq, PutAppendReply{Err: OK}}
+}
 
+// wait for cond, for at most d. muView must be held.
+func (pb *PBServer) wait(d time.Duration) {
+	t := time.AfterFunc(d, func() {
+		pb.impl.muView.Lock()
+		pb.impl.cond.Broadcast()
+		pb.impl.muView.Unlock()
+	})
+	pb.impl.cond.Wait()
+	t.Stop()
 }
 
 //	func (pb *PBServer) isBackup() bool {
@@ -150,20 +257,26 @@ func (pb *PBServer) getBackup() string {
 	return pb.impl.view.Backup
 }
 
-func (pb *PBServer) isApplied(id int64) bool {
-	_, ok := pb.impl.appliedRequests[id]
-	return ok
+// a clerk only sends a request once the one before is done, so it is
+// a duplicate unless its seq is the client's highest yet.
+func (pb *PBServer) isApplied(req PutAppendArgsImpl) bool {
+	return req.Seq <= pb.impl.clients[req.Client].Seq
 }
-func (pb *PBServer) viewChanged(view1 *viewservice.View, view2 *viewservice.View) bool {
+func (pb *PBServer) viewChanged(view1 *viewservice.FullView, view2 *viewservice.FullView) bool {
 	if view1.Viewnum != view2.Viewnum {
 		return true
 	}
 	if view1.Primary != view2.Primary {
 		return true
 	}
-	if view1.Backup != view2.Backup {
+	if len(view1.Backups) != len(view2.Backups) {
 		return true
 	}
+	for i := range view1.Backups {
+		if view1.Backups[i] != view2.Backups[i] {
+			return true
+		}
+	}
 	return false
 }
 
@@ -171,22 +284,6 @@ func (pb *PBServer) viewChanged(view1 *viewservice.View, view2 *viewservice.View
 // add RPC handlers for any new RPCs that you include in your design.
 //
 
-func (pb *PBServer) SyncDB(args *SyncDBArg, reply *SyncReply) error {
-	pb.impl.muGlobal.Lock()
-	defer pb.impl.muGlobal.Unlock()
-	pb.impl.muView.Lock()
-	defer pb.impl.muView.Unlock()
-	// log.Printf("received view %v, myview %v", args.View, pb.impl.view)
-	if args.View.Viewnum == pb.impl.view.Viewnum {
-		pb.impl.database = args.Database
-		pb.impl.appliedRequests = args.AppliedRequests
-		reply.Ok = true
-	} else {
-		reply.Ok = false
-	}
-	return nil
-}
-
 func (pb *PBServer) SyncGet(args *SyncGetArg, reply *SyncGetReply) error {
 	pb.impl.muGlobal.Lock()
 	defer pb.impl.muGlobal.Unlock()
@@ -206,9 +303,13 @@ func (pb *PBServer) SyncPutAppend(args *SyncPutAppendArg, reply *SyncPutAppendRe
 	pb.impl.muView.Lock()
 	defer pb.impl.muView.Unlock()
 	// log.Printf("received view %v, myview %v", args.View, pb.impl.view)
-	if args.View.Viewnum == pb.impl.view.Viewnum {
-		if !pb.isApplied(args.Args.Impl.Id) {
-			pb.doPutAppend(args.Args)
+	if args.View.Viewnum == pb.impl.view.Viewnum && args.Session != pb.impl.session {
+		reply.Lost = true
+	} else if args.View.Viewnum == pb.impl.view.Viewnum {
+		for _, op := range args.Ops {
+			if !pb.isApplied(op.Impl) {
+				pb.doPutAppend(op)
+			}
 		}
 		reply.Ok = true
 	} else {
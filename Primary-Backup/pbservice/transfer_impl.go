@@ -0,0 +1,394 @@
+package pbservice
+
+import (
+	"hash/fnv"
+	"time"
+
+	"proj2/viewservice"
+)
+
+// a new backup gets the primary's state in pages of about PageBytes,
+// sent in the background while the primary keeps serving clients:
+// first the database and the client records as the primary goes
+// through them, then the keys and records that clients changed
+// meanwhile, until none are left. the last page is sent with the locks
+// held, and from then on the backup gets every op forwarded. pages are
+// numbered within a session, so a lost one is just sent again, and a
+// transfer goes on across view changes that keep the backup. the
+// primary acks a view only once every backup has been told it is
+// complete for that view.
+const PageBytes = 64 * 1024
+
+// every server keeps a digest of the keys in each of DigestBuckets
+// buckets, the XOR of a hash of every key and value in it, updated as
+// keys change. a transfer starts by fetching the backup's digests, and
+// only the buckets whose digests differ are sent, after the backup
+// empties them; a backup that kept its state, e.g. in durable mode,
+// only gets what changed.
+const DigestBuckets = 1024
+
+func bucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % DigestBuckets)
+}
+
+func pairHash(key string, value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// set key to value, keeping the digests up to date. muGlobal must be
+// held.
+func (pb *PBServer) setValue(key string, value string) {
+	b := bucket(key)
+	if old, ok := pb.impl.database[key]; ok {
+		pb.impl.digests[b] ^= pairHash(key, old)
+	}
+	pb.impl.digests[b] ^= pairHash(key, value)
+	pb.impl.database[key] = value
+}
+
+// remove the keys in the buckets. muGlobal must be held.
+func (pb *PBServer) emptyBuckets(buckets []int) {
+	if len(buckets) == 0 {
+		return
+	}
+	empty := make(map[int]bool)
+	for _, b := range buckets {
+		empty[b] = true
+		pb.impl.digests[b] = 0
+	}
+	for k := range pb.impl.database {
+		if empty[bucket(k)] {
+			delete(pb.impl.database, k)
+		}
+	}
+}
+
+// the primary's state for a backup of its view, guarded by muView.
+type backupImpl struct {
+	session int64
+	next    int             // sequence number of the next page
+	stale   []bool          // the buckets to send, once the digests are in
+	sent    bool            // the snapshot pages went out
+	live    bool            // has everything; new ops are forwarded to it
+	dirty   map[string]bool // keys changed since the transfer began
+	clients map[int64]bool  // clients whose requests were applied meanwhile
+	synced  uint            // the last view it was told is complete
+	running bool            // a transfer goroutine works on it
+}
+
+func newBackup() *backupImpl {
+	return &backupImpl{session: nrand(), dirty: make(map[string]bool),
+		clients: make(map[int64]bool)}
+}
+
+// the primary has moved to a new view: start a transfer to every
+// backup that needs one. in chain mode the backups do not get ops
+// forwarded by the primary, so they all get the whole state again.
+// muView must be held.
+func (pb *PBServer) startTransfers() {
+	backups := make(map[string]*backupImpl)
+	for _, backup := range pb.impl.view.Backups {
+		st, ok := pb.impl.backups[backup]
+		if !ok || pb.impl.chain {
+			st = newBackup()
+		}
+		backups[backup] = st
+		if !st.running {
+			st.running = true
+			go pb.transfer(backup, st)
+		}
+	}
+	pb.impl.backups = backups
+	pb.checkSynced()
+}
+
+// the backup has lost its state, e.g. in a restart: start over.
+// muView must be held.
+func (pb *PBServer) resetBackup(backup string) {
+	st := newBackup()
+	st.running = true
+	pb.impl.backups[backup] = st
+	go pb.transfer(backup, st)
+}
+
+// ack the view once every backup is complete for it. muView must be
+// held.
+func (pb *PBServer) checkSynced() {
+	if pb.impl.pingnum == pb.impl.view.Viewnum {
+		return
+	}
+	for _, st := range pb.impl.backups {
+		if st.synced != pb.impl.view.Viewnum {
+			return
+		}
+	}
+	pb.setPingnum(pb.impl.view.Viewnum)
+	if pb.impl.chain {
+		pb.resetChain()
+	}
+}
+
+// whether st is still the state of a backup of this primary.
+func (pb *PBServer) transferring(backup string, st *backupImpl) bool {
+	return !pb.isdead() && pb.isPrimary() && pb.impl.backups[backup] == st
+}
+
+// bring the backup up to date for the current view, and keep at it
+// across view changes until it is, or it stops being a backup.
+func (pb *PBServer) transfer(backup string, st *backupImpl) {
+	pb.impl.muGlobal.Lock()
+	pb.impl.muView.Lock()
+	defer func() {
+		st.running = false
+		pb.impl.muView.Unlock()
+		pb.impl.muGlobal.Unlock()
+	}()
+	for pb.transferring(backup, st) && st.synced != pb.impl.view.Viewnum {
+		if !st.live && !st.sent {
+			pb.sendSnapshot(backup, st)
+		} else if !st.live && (len(st.dirty) > 0 || len(st.clients) > 0) {
+			page := pb.dirtyPage(st)
+			pb.sendPage(backup, st, &page)
+		} else if !pb.sendLast(backup, st) {
+			pb.impl.muView.Unlock()
+			pb.impl.muGlobal.Unlock()
+			time.Sleep(viewservice.PingInterval)
+			pb.impl.muGlobal.Lock()
+			pb.impl.muView.Lock()
+		}
+	}
+}
+
+// roughly, in a page.
+const clientRecordBytes = 24
+
+func newPage() SyncPageArg {
+	return SyncPageArg{Database: make(map[string]string), Clients: make(map[int64]ClientRecord)}
+}
+
+// send the keys in the buckets that differ from the backup's, and the
+// client records, as they are while going through them. muGlobal and
+// muView must be held, and are released while sending.
+func (pb *PBServer) sendSnapshot(backup string, st *backupImpl) {
+	if st.stale == nil && !pb.fetchDigests(backup, st) {
+		return
+	}
+	page, size := newPage(), 0
+	for k, v := range pb.impl.database {
+		if !st.stale[bucket(k)] {
+			continue
+		}
+		page.Database[k] = v
+		size += len(k) + len(v)
+		if size >= PageBytes {
+			if !pb.sendPage(backup, st, &page) {
+				return
+			}
+			page, size = newPage(), 0
+		}
+	}
+	for c, r := range pb.impl.clients {
+		page.Clients[c] = r
+		size += clientRecordBytes
+		if size >= PageBytes {
+			if !pb.sendPage(backup, st, &page) {
+				return
+			}
+			page, size = newPage(), 0
+		}
+	}
+	if (size > 0 || st.next == 0) && !pb.sendPage(backup, st, &page) {
+		return
+	}
+	st.sent = true
+}
+
+// find out which buckets the backup needs; false if the transfer is
+// over meanwhile. muGlobal and muView must be held, and are released
+// while asking.
+func (pb *PBServer) fetchDigests(backup string, st *backupImpl) bool {
+	for pb.transferring(backup, st) {
+		args := SyncDigestArg{pb.impl.view.View}
+		var reply SyncDigestReply
+		pb.impl.muView.Unlock()
+		pb.impl.muGlobal.Unlock()
+		ok := call(backup, "PBServer.SyncDigest", &args, &reply)
+		if !ok || !reply.Ok {
+			time.Sleep(viewservice.PingInterval)
+		}
+		pb.impl.muGlobal.Lock()
+		pb.impl.muView.Lock()
+		if ok && reply.Ok && pb.transferring(backup, st) {
+			st.stale = make([]bool, DigestBuckets)
+			for b := range st.stale {
+				st.stale[b] = reply.Digests[b] != pb.impl.digests[b]
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// the buckets the backup empties before the first page.
+func (st *backupImpl) staleBuckets() []int {
+	buckets := make([]int, 0)
+	for b, stale := range st.stale {
+		if stale {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// a page of the keys and client records changed since the transfer
+// began, as they are now. muGlobal and muView must be held.
+func (pb *PBServer) dirtyPage(st *backupImpl) SyncPageArg {
+	page, size := newPage(), 0
+	for k := range st.dirty {
+		if size >= PageBytes {
+			break
+		}
+		page.Database[k] = pb.impl.database[k]
+		size += len(k) + len(page.Database[k])
+		delete(st.dirty, k)
+	}
+	for c := range st.clients {
+		if size >= PageBytes {
+			break
+		}
+		page.Clients[c] = pb.impl.clients[c]
+		size += clientRecordBytes
+		delete(st.clients, c)
+	}
+	return page
+}
+
+// send the next page of the transfer until the backup has it; false if
+// the transfer is over meanwhile. muGlobal and muView must be held, and
+// are released while sending.
+func (pb *PBServer) sendPage(backup string, st *backupImpl, page *SyncPageArg) bool {
+	page.Session, page.Seq = st.session, st.next
+	if st.next == 0 {
+		page.Stale = st.staleBuckets()
+	}
+	for pb.transferring(backup, st) {
+		page.View = pb.impl.view.View
+		var reply SyncPageReply
+		pb.impl.muView.Unlock()
+		pb.impl.muGlobal.Unlock()
+		ok := call(backup, "PBServer.SyncPage", page, &reply)
+		if !ok || !reply.Ok {
+			time.Sleep(viewservice.PingInterval)
+		}
+		pb.impl.muGlobal.Lock()
+		pb.impl.muView.Lock()
+		if ok && reply.Lost && pb.transferring(backup, st) {
+			pb.resetBackup(backup)
+		} else if ok && reply.Ok {
+			st.next++
+			return true
+		}
+	}
+	return false
+}
+
+// everything has been sent: tell the backup it is complete for the
+// view. the locks stay held, so that no op is applied in between
+// without being forwarded. false if the backup did not get it.
+func (pb *PBServer) sendLast(backup string, st *backupImpl) bool {
+	page := SyncPageArg{View: pb.impl.view.View, Session: st.session, Seq: st.next, Last: true}
+	var reply SyncPageReply
+	ok := call(backup, "PBServer.SyncPage", &page, &reply)
+	if ok && reply.Lost {
+		pb.resetBackup(backup)
+		return false
+	}
+	if !ok || !reply.Ok {
+		return false
+	}
+	st.next++
+	st.live = true
+	st.dirty, st.clients = nil, nil
+	st.synced = page.View.Viewnum
+	pb.checkSynced()
+	return true
+}
+
+// a request of client changed key: backups being brought up to date
+// need both again. muGlobal and muView must be held.
+func (pb *PBServer) markDirty(key string, client int64) {
+	for _, st := range pb.impl.backups {
+		if !st.live {
+			st.dirty[key] = true
+			st.clients[client] = true
+		}
+	}
+}
+
+// SyncDigest RPC handler: the digests of the backup's database.
+func (pb *PBServer) SyncDigest(args *SyncDigestArg, reply *SyncDigestReply) error {
+	pb.impl.muGlobal.Lock()
+	defer pb.impl.muGlobal.Unlock()
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	if args.View.Viewnum != pb.impl.view.Viewnum {
+		reply.Ok = false
+		return nil
+	}
+	reply.Digests = append([]uint64{}, pb.impl.digests...)
+	reply.Ok = true
+	return nil
+}
+
+// SyncPage RPC handler: a page of the primary's state.
+func (pb *PBServer) SyncPage(args *SyncPageArg, reply *SyncPageReply) error {
+	pb.impl.muGlobal.Lock()
+	defer pb.impl.muGlobal.Unlock()
+	pb.impl.muView.Lock()
+	defer pb.impl.muView.Unlock()
+	if args.View.Viewnum != pb.impl.view.Viewnum {
+		reply.Ok = false
+		return nil
+	}
+	first := args.Seq == 0 && args.Session != pb.impl.session
+	if !first && args.Session != pb.impl.session {
+		reply.Lost = true
+		return nil
+	}
+	if !first && args.Seq > pb.impl.nextPage {
+		reply.Ok = false
+		return nil
+	}
+	if first || args.Seq == pb.impl.nextPage {
+		pb.applyPage(args)
+		pb.logRecord(walRecord{Page: args})
+		if args.Last && pb.impl.chain {
+			pb.resetChain()
+		}
+	}
+	reply.Ok = true
+	return nil
+}
+
+// the first page of a session empties the stale buckets and replaces
+// the client records.
+func (pb *PBServer) applyPage(page *SyncPageArg) {
+	if page.Seq == 0 && page.Session != pb.impl.session {
+		pb.emptyBuckets(page.Stale)
+		pb.impl.clients = make(map[int64]ClientRecord)
+		pb.impl.session, pb.impl.nextPage = page.Session, 0
+	}
+	for k, v := range page.Database {
+		pb.setValue(k, v)
+	}
+	for c, r := range page.Clients {
+		pb.impl.clients[c] = r
+	}
+	pb.impl.nextPage++
+}
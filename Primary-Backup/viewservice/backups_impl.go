@@ -0,0 +1,87 @@
+package viewservice
+
+import "sync"
+
+// a view can have several backups, in the order they would take over
+// as primary. the Ping and Get RPCs reply with View, whose Backup is
+// the first of them; PingFull and GetFull reply with all of them.
+type FullView struct {
+	View
+	Backups []string
+}
+
+// how many backups a view has when there are enough idle servers,
+// unless the viewserver is started with another number.
+const DefaultBackups = 1
+
+type PingFullReply struct {
+	View FullView
+}
+
+type GetFullReply struct {
+	View FullView
+}
+
+// views are never changed once made, so they can be handed out while
+// the viewserver goes on to the next one.
+func makeView(viewnum uint, primary string, backups []string) *FullView {
+	v := &FullView{View{viewnum, primary, UNASSIGNED}, append([]string{}, backups...)}
+	if len(backups) > 0 {
+		v.Backup = backups[0]
+	}
+	return v
+}
+
+func (v *FullView) hasBackup(server string) bool {
+	for _, backup := range v.Backups {
+		if backup == server {
+			return true
+		}
+	}
+	return false
+}
+
+// how a viewserver being started is set up, by its address, for
+// initImpl to pick up.
+type serverConf struct {
+	backups int
+	peers   []string // of a replica
+	me      int
+	durable bool // save views, see StartDurableServer
+}
+
+var serverConfs = make(map[string]serverConf)
+var muServerConfs sync.Mutex
+
+func startServerWithConf(me string, conf serverConf) *ViewServer {
+	muServerConfs.Lock()
+	serverConfs[me] = conf
+	muServerConfs.Unlock()
+	return StartServer(me)
+}
+
+func takeServerConf(me string) (serverConf, bool) {
+	muServerConfs.Lock()
+	defer muServerConfs.Unlock()
+	conf, ok := serverConfs[me]
+	delete(serverConfs, me)
+	return conf, ok
+}
+
+// like StartServer, but views get up to backups backups.
+func StartServerWithBackups(me string, backups int) *ViewServer {
+	return startServerWithConf(me, serverConf{backups: backups})
+}
+
+func (ck *Clerk) PingFull(viewnum uint) (FullView, error) {
+	v, _, err := ck.PingLease(viewnum)
+	return v, err
+}
+
+func (ck *Clerk) GetFull() (FullView, bool) {
+	var reply GetFullReply
+	if !call(ck.server, "ViewServer.GetFull", &GetArgs{}, &reply) {
+		return FullView{}, false
+	}
+	return reply.View, true
+}
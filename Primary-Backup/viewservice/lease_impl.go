@@ -0,0 +1,57 @@
+package viewservice
+
+import (
+	"fmt"
+	"time"
+)
+
+// the primary gets a lease of LeaseTime with every ping that acks the
+// current view. while the lease lasts the viewserver does not move to
+// a view with another primary, which is the backup's promise not to
+// take over, so the primary can serve Gets without asking the backup.
+// the primary counts its lease from when it sent the ping. replicated
+// viewservers count it from the time in the PING op, so their clocks
+// must agree to well within LeaseTime.
+const LeaseTime = 3 * PingInterval
+
+type PingLeaseReply struct {
+	View  FullView
+	Lease time.Duration // 0 if none was granted
+}
+
+// like PingFull, and grants a lease to the primary.
+func (vs *ViewServer) PingLease(args *PingArgs, reply *PingLeaseReply) error {
+	v, lease := vs.ping(args)
+	reply.View, reply.Lease = *v, lease
+	return nil
+}
+
+// the primary acked the current view at vs.impl.now.
+func (vs *ViewServer) grantLease() {
+	vs.impl.leaseEnd = vs.impl.now + int64(LeaseTime)
+}
+
+// whether the primary of the current view may still hold a lease, so
+// that v must wait.
+func (vs *ViewServer) leaseHeld(v *FullView) bool {
+	return v.Primary != vs.impl.view.Primary && vs.impl.now < vs.impl.leaseEnd
+}
+
+// like PingFull, along with the lease the ping got the primary.
+func (ck *Clerk) PingLease(viewnum uint) (FullView, time.Duration, error) {
+	args := &PingArgs{Me: ck.me, Viewnum: viewnum}
+	var reply PingLeaseReply
+	if !call(ck.server, "ViewServer.PingLease", args, &reply) {
+		return FullView{}, 0, fmt.Errorf("Ping(%v) failed", viewnum)
+	}
+	return reply.View, reply.Lease, nil
+}
+
+func (ck *ReplicatedClerk) PingLease(viewnum uint) (FullView, time.Duration, error) {
+	args := &PingArgs{Me: ck.me, Viewnum: viewnum}
+	var reply PingLeaseReply
+	if !ck.call("ViewServer.PingLease", args, &reply) {
+		return FullView{}, 0, fmt.Errorf("Ping(%v) failed", viewnum)
+	}
+	return reply.View, reply.Lease, nil
+}
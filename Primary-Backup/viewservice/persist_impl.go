@@ -0,0 +1,75 @@
+package viewservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"proj2/common"
+)
+
+// a durable viewserver saves every view it moves to in a file next to
+// its socket, as JSON, so that a restarted viewserver carries on from
+// its last view instead of view 0, where it could make a stale server
+// primary. only the latest view is kept.
+func viewFileName(me string) string {
+	return me + ".views"
+}
+
+// like StartServer, but the views are saved, and a viewserver
+// restarted at the same address starts from the last of them.
+func StartDurableServer(me string) *ViewServer {
+	return startServerWithConf(me, serverConf{durable: true})
+}
+
+// save v as the latest view, atomically and durably, if the viewserver
+// is durable. replicas keep no file, their Paxos peers remember the
+// views for them.
+func (vs *ViewServer) saveView(v *FullView) error {
+	if vs.impl.viewFile == "" {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(vs.impl.viewFile, append(b, '\n'))
+}
+
+// reload the saved view, if there is one. its servers count as alive
+// until they miss DeadPings pings, and primaryViewNum starts over, so
+// the view does not change until its primary acknowledges it again:
+// the primary may have crashed or restarted along with the viewserver,
+// and must not be replaced behind its back.
+func (vs *ViewServer) restoreView() {
+	b, err := os.ReadFile(vs.impl.viewFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Println("cannot read saved view:", err)
+		return
+	}
+	// a file from before views were saved this way holds every view,
+	// one per line; the last complete one is the latest.
+	var last *FullView
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var v FullView
+		if json.Unmarshal(line, &v) == nil {
+			last = &v
+		}
+	}
+	if last == nil {
+		return
+	}
+	vs.impl.view = last
+	// the primary may hold a lease from before the restart.
+	vs.impl.leaseEnd = time.Now().UnixNano() + int64(LeaseTime)
+	for _, server := range append([]string{last.Primary}, last.Backups...) {
+		if server != UNASSIGNED {
+			vs.impl.machines[server] = DeadPings
+			vs.impl.used[server] = 1
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package viewservice
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"time"
+
+	"proj2/paxos"
+	"proj2/paxosrsm"
+)
+
+// a replicated viewservice runs a viewserver at each of several
+// addresses. the replicas put every ping, tick and Get through a Paxos
+// log before acting on it, so they all go through the same views and
+// any of them can answer while a majority is up. each replica's Paxos
+// peer listens at its address plus "-paxos".
+//
+// the paxos and paxosrsm packages are a copy of proj3's, as
+// ShardedKV-Paxos keeps its own. proj2's skeleton has no Paxos, so the
+// copy brings the parts of proj3's skeleton they need as well (paxos.go,
+// rsm.go and common.Call), and proj2 builds without
+// proj3.
+//
+// a replica holds muGlobal while an op goes through Paxos, so its
+// pings, ticks and Gets are serialized on purpose: AddOp is not safe
+// for concurrent use, the log is sequential anyway, and applyOp changes
+// the state muGlobal guards. a slow agreement holds up the ops behind
+// it either way.
+
+// what the replicas agree on, one per Paxos instance.
+type ViewOp struct {
+	Type    EventType
+	Me      string
+	Viewnum uint
+	Time    int64 // of a TICK or PING, in nanoseconds
+	Id      int64 // tells apart otherwise identical ops
+}
+
+// start replica me of a viewservice replicated at servers.
+func StartReplica(servers []string, me int) *ViewServer {
+	return StartReplicaWithBackups(servers, me, DefaultBackups)
+}
+
+// like StartReplica, but views get up to backups backups. all the
+// replicas must be started with the same number.
+func StartReplicaWithBackups(servers []string, me int, backups int) *ViewServer {
+	peers := make([]string, len(servers))
+	for i, server := range servers {
+		peers[i] = server + "-paxos"
+	}
+	return startServerWithConf(servers[me], serverConf{backups: backups, peers: peers, me: me})
+}
+
+// stop a replica started with StartReplica.
+func (vs *ViewServer) KillReplica() {
+	vs.Kill()
+	vs.impl.px.Kill()
+}
+
+// set up Paxos for a viewserver being started as a replica.
+func (vs *ViewServer) initReplica(conf serverConf) {
+	gob.Register(ViewOp{})
+	vs.impl.px = paxos.Make(conf.peers, conf.me, nil)
+	vs.impl.rsm = paxosrsm.MakeRSM(conf.me, vs.impl.px, vs.applyOp)
+}
+
+// apply an op decided in the Paxos log; called by the rsm with the
+// global lock held.
+func (vs *ViewServer) applyOp(v interface{}) {
+	op := v.(ViewOp)
+	if op.Time != 0 {
+		vs.impl.now = op.Time
+	}
+	switch op.Type {
+	case PING:
+		vs.handlePing(op.Me, op.Viewnum)
+	case TICK:
+		// every replica proposes ticks, so they count by the times
+		// in them rather than by how many there are.
+		if vs.impl.lastTick == 0 {
+			vs.impl.lastTick = op.Time
+			vs.handleTick()
+			return
+		}
+		n := (op.Time - vs.impl.lastTick) / int64(PingInterval)
+		if n <= 0 {
+			return
+		}
+		vs.impl.lastTick += n * int64(PingInterval)
+		for i := int64(0); i < n && i < DeadPings; i++ {
+			vs.handleTick()
+		}
+	}
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+// a replica that dies with an op in Paxos never answers the RPC that
+// proposed it, so a clerk gives up on a replica after ReplicaTimeout.
+const ReplicaTimeout = 10 * PingInterval
+
+// like Clerk, for a replicated viewservice: it tries the replicas in
+// turn, starting with the last one that answered.
+type ReplicatedClerk struct {
+	me      string
+	servers []string
+	last    int
+	mu      sync.Mutex
+}
+
+func MakeReplicatedClerk(me string, servers []string) *ReplicatedClerk {
+	return &ReplicatedClerk{me: me, servers: servers}
+}
+
+func (ck *ReplicatedClerk) Ping(viewnum uint) (View, error) {
+	args := &PingArgs{Me: ck.me, Viewnum: viewnum}
+	var reply PingReply
+	if !ck.call("ViewServer.Ping", args, &reply) {
+		return View{}, fmt.Errorf("Ping(%v) failed", viewnum)
+	}
+	return reply.View, nil
+}
+
+func (ck *ReplicatedClerk) PingFull(viewnum uint) (FullView, error) {
+	v, _, err := ck.PingLease(viewnum)
+	return v, err
+}
+
+func (ck *ReplicatedClerk) Get() (View, bool) {
+	var reply GetReply
+	if !ck.call("ViewServer.Get", &GetArgs{}, &reply) {
+		return View{}, false
+	}
+	return reply.View, true
+}
+
+func (ck *ReplicatedClerk) GetFull() (FullView, bool) {
+	var reply GetFullReply
+	if !ck.call("ViewServer.GetFull", &GetArgs{}, &reply) {
+		return FullView{}, false
+	}
+	return reply.View, true
+}
+
+func (ck *ReplicatedClerk) Primary() string {
+	v, ok := ck.Get()
+	if ok {
+		return v.Primary
+	}
+	return ""
+}
+
+func (ck *ReplicatedClerk) call(rpcname string, args interface{}, reply interface{}) bool {
+	ck.mu.Lock()
+	start := ck.last
+	ck.mu.Unlock()
+	for i := range ck.servers {
+		server := (start + i) % len(ck.servers)
+		if callTimeout(ck.servers[server], rpcname, args, reply) {
+			ck.mu.Lock()
+			ck.last = server
+			ck.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// like call, but false after ReplicaTimeout without a reply. the RPC
+// fills in a reply of its own, so one that comes too late is dropped.
+func callTimeout(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	r := reflect.New(reflect.TypeOf(reply).Elem())
+	done := make(chan bool, 1)
+	go func() {
+		done <- call(srv, rpcname, args, r.Interface())
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			reflect.ValueOf(reply).Elem().Set(r.Elem())
+		}
+		return ok
+	case <-time.After(ReplicaTimeout):
+		return false
+	}
+}
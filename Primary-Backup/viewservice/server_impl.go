@@ -3,6 +3,10 @@ package viewservice
 import (
 	"fmt"
 	"sync"
+	"time"
+
+	"proj2/paxos"
+	"proj2/paxosrsm"
 )
 
 type EventType int32
@@ -11,15 +15,25 @@ const (
 	PING         EventType = iota
 	PRIMARY_FAIL EventType = iota
 	BACKUP_FAIL  EventType = iota
+	TICK         EventType = iota
+	GET          EventType = iota
 )
 
 // additions to ViewServer state.
 type ViewServerImpl struct {
 	machines       map[string]int
 	used           map[string]int
-	view           *View
-	nextView       *View
+	view           *FullView
+	nextView       *FullView
 	primaryViewNum uint
+	acked          *FullView // the last view its primary acknowledged
+	backups        int
+	viewFile       string
+	px             *paxos.Paxos
+	rsm            *paxosrsm.PaxosRSM
+	lastTick       int64
+	now            int64 // time of the event being handled, in nanoseconds
+	leaseEnd       int64 // of the primary's lease
 	muGlobal       sync.Mutex
 }
 
@@ -29,28 +43,49 @@ const UNASSIGNED = ""
 func (vs *ViewServer) initImpl() {
 	vs.impl.machines = make(map[string]int)
 	vs.impl.used = make(map[string]int)
-	vs.impl.view = &View{0, UNASSIGNED, UNASSIGNED}
+	vs.impl.view = makeView(0, UNASSIGNED, nil)
 	vs.impl.nextView = nil
 	vs.impl.primaryViewNum = 0
+	vs.impl.backups = DefaultBackups
+	conf, ok := takeServerConf(vs.me)
+	if ok && conf.backups > 0 {
+		vs.impl.backups = conf.backups
+	}
+	if ok && conf.peers != nil {
+		vs.initReplica(conf)
+	} else if ok && conf.durable {
+		vs.impl.viewFile = viewFileName(vs.me)
+		vs.restoreView()
+	}
 }
 
 // server Ping() RPC handler.
 func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
+	v, _ := vs.ping(args)
+	reply.View = v.View
+	return nil
+}
+
+// like Ping, but replies with every backup.
+func (vs *ViewServer) PingFull(args *PingArgs, reply *PingFullReply) error {
+	v, _ := vs.ping(args)
+	reply.View = *v
+	return nil
+}
+
+// the view to reply with, and the lease granted to the primary. in a
+// replica the ping goes through Paxos with muGlobal held; see
+// replicated_impl.go.
+func (vs *ViewServer) ping(args *PingArgs) (*FullView, time.Duration) {
 	vs.impl.muGlobal.Lock()
 	defer vs.impl.muGlobal.Unlock()
-	_, exist := vs.impl.machines[args.Me] // check if the pinging server exist
-	vs.impl.machines[args.Me] = DeadPings // restart ttl
-	if !exist {
-		vs.impl.used[args.Me] = 0
-		vs.handleNewMachine()
-	} else if args.Viewnum == 0 {
-		vs.impl.used[args.Me] = 0
-		vs.handleMachineFailure(args.Me)
-	}
-	if args.Me == vs.impl.view.Primary && args.Viewnum != 0 {
-		vs.impl.primaryViewNum = args.Viewnum
+	now := time.Now().UnixNano()
+	if vs.impl.rsm != nil {
+		vs.impl.rsm.AddOp(ViewOp{Type: PING, Me: args.Me, Viewnum: args.Viewnum, Time: now, Id: nrand()})
+	} else {
+		vs.impl.now = now
+		vs.handlePing(args.Me, args.Viewnum)
 	}
-	vs.tryAdvanceView()
 
 	// fmt.Println("----------------------")
 	// fmt.Println(vs.impl.primaryViewNum)
@@ -58,20 +93,35 @@ func (vs *ViewServer) Ping(args *PingArgs, reply *PingReply) error {
 	// fmt.Println(vs.impl.nextView)
 	// fmt.Println(vs.impl.machines)
 	// fmt.Println("----------------------")
+	v := vs.impl.view
 	if vs.impl.nextView != nil && vs.impl.nextView.Viewnum-vs.impl.primaryViewNum == 1 {
-		reply.View = *vs.impl.nextView
-	} else {
-		reply.View = *vs.impl.view
+		v = vs.impl.nextView
 	}
-	return nil
+	if args.Me == v.Primary && args.Viewnum == v.Viewnum && vs.impl.acked == v {
+		return v, LeaseTime
+	}
+	return v, 0
 }
 
 // server Get() RPC handler.
 func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
+	reply.View = vs.get().View
+	return nil
+}
+
+// like Get, but replies with every backup.
+func (vs *ViewServer) GetFull(args *GetArgs, reply *GetFullReply) error {
+	reply.View = *vs.get()
+	return nil
+}
+
+func (vs *ViewServer) get() *FullView {
 	vs.impl.muGlobal.Lock()
 	defer vs.impl.muGlobal.Unlock()
-	reply.View = *vs.impl.view
-	return nil
+	if vs.impl.rsm != nil {
+		vs.impl.rsm.AddOp(ViewOp{Type: GET, Id: nrand()})
+	}
+	return vs.impl.view
 }
 
 // tick() is called once per PingInterval; it should notice
@@ -80,6 +130,41 @@ func (vs *ViewServer) Get(args *GetArgs, reply *GetReply) error {
 func (vs *ViewServer) tick() {
 	vs.impl.muGlobal.Lock()
 	defer vs.impl.muGlobal.Unlock()
+	if vs.impl.rsm != nil {
+		now := time.Now().UnixNano()
+		if now-vs.impl.lastTick >= int64(PingInterval) {
+			vs.impl.rsm.AddOp(ViewOp{Type: TICK, Time: now, Id: nrand()})
+		}
+		return
+	}
+	vs.impl.now = time.Now().UnixNano()
+	vs.handleTick()
+}
+
+/* helper functions, global lock should not be acquired*/
+
+func (vs *ViewServer) handlePing(me string, viewnum uint) {
+	_, exist := vs.impl.machines[me] // check if the pinging server exist
+	vs.impl.machines[me] = DeadPings // restart ttl
+	if !exist {
+		vs.impl.used[me] = 0
+		vs.handleNewMachine()
+		vs.handleRejoin(me, viewnum)
+	} else if viewnum == 0 {
+		vs.impl.used[me] = 0
+		vs.handleMachineFailure(me)
+	}
+	if me == vs.impl.view.Primary && viewnum != 0 {
+		vs.impl.primaryViewNum = viewnum
+		if viewnum == vs.impl.view.Viewnum {
+			vs.impl.acked = vs.impl.view
+			vs.grantLease()
+		}
+	}
+	vs.tryAdvanceView()
+}
+
+func (vs *ViewServer) handleTick() {
 	newMachines := make(map[string]int)
 	failedMachines := []string{}
 	for k, v := range vs.impl.machines {
@@ -97,55 +182,114 @@ func (vs *ViewServer) tick() {
 	vs.tryAdvanceView()
 }
 
-/* helper functions, global lock should not be acquired*/
-
 func (vs *ViewServer) handleMachineFailure(failedMachine string) {
-	if failedMachine == vs.impl.view.Primary {
-		// fmt.Println("handle primary failure", vs.impl.view.Primary)
-		if vs.impl.view.Backup == UNASSIGNED {
-			fmt.Println("no backup to be promoted to primary")
+	// build on the next view if there is one, so that servers failing
+	// together are all replaced.
+	view := vs.impl.view
+	if vs.impl.nextView != nil {
+		view = vs.impl.nextView
+	}
+	if failedMachine != view.Primary && !view.hasBackup(failedMachine) {
+		return
+	}
+	primary, backups := view.Primary, []string{}
+	for _, backup := range view.Backups {
+		if backup != failedMachine {
+			backups = append(backups, backup)
 		}
-
-		vs.impl.nextView = &View{vs.impl.view.Viewnum + 1, vs.impl.view.Backup, UNASSIGNED}
-		newBackup := vs.getIdleMachine()
-		if newBackup != "" {
-			vs.impl.nextView.Backup = newBackup
+	}
+	if failedMachine == view.Primary {
+		// fmt.Println("handle primary failure", vs.impl.view.Primary)
+		// promote the first backup that has the data: one that was in a
+		// view the viewserver moved to, and has not restarted since.
+		primary = UNASSIGNED
+		for i, backup := range backups {
+			if vs.impl.used[backup] == 1 {
+				primary = backup
+				backups = append(backups[:i:i], backups[i+1:]...)
+				break
+			}
 		}
-	} else if failedMachine == vs.impl.view.Backup { //may need to consider when backup fails before proper view advance
-		newBackup := vs.getIdleMachine()
-		if newBackup != "" {
-			vs.impl.nextView = &View{vs.impl.view.Viewnum + 1, vs.impl.view.Primary, newBackup}
-		} else {
-			vs.impl.nextView = &View{vs.impl.view.Viewnum + 1, vs.impl.view.Primary, UNASSIGNED}
+		if primary == UNASSIGNED {
+			fmt.Println("no backup to be promoted to primary")
 		}
 	}
+	vs.impl.nextView = makeView(vs.impl.view.Viewnum+1, primary, backups)
+	vs.fillBackups(vs.impl.nextView)
 }
 
 func (vs *ViewServer) handleNewMachine() {
 	if vs.impl.view.Primary == UNASSIGNED {
-		newPrimary := vs.getIdleMachine()
-		vs.impl.nextView = &View{vs.impl.view.Viewnum + 1, newPrimary, UNASSIGNED}
-	} else if vs.impl.view.Backup == UNASSIGNED {
-		newBackup := vs.getIdleMachine()
-		vs.impl.nextView = &View{vs.impl.view.Viewnum + 1, vs.impl.view.Primary, newBackup}
+		newPrimary := vs.getIdleMachine(nil)
+		vs.impl.nextView = makeView(vs.impl.view.Viewnum+1, newPrimary, nil)
+	} else if len(vs.impl.view.Backups) < vs.impl.backups {
+		vs.impl.nextView = makeView(vs.impl.view.Viewnum+1, vs.impl.view.Primary, vs.impl.view.Backups)
+		vs.fillBackups(vs.impl.nextView)
+	}
+}
+
+// add idle machines to v until it has as many backups as it should.
+func (vs *ViewServer) fillBackups(v *FullView) {
+	for len(v.Backups) < vs.impl.backups {
+		newBackup := vs.getIdleMachine(v)
+		if newBackup == "" {
+			break
+		}
+		v.Backups = append(v.Backups, newBackup)
+	}
+	if len(v.Backups) > 0 {
+		v.Backup = v.Backups[0]
 	}
 }
 
-func (vs *ViewServer) getIdleMachine() string {
+// an idle machine that is not already in v, or "".
+func (vs *ViewServer) getIdleMachine(v *FullView) string {
 	for k, _ := range vs.impl.machines {
-		if vs.impl.used[k] == 0 {
+		if vs.impl.used[k] == 0 && (v == nil || (k != v.Primary && !v.hasBackup(k))) {
 			return k
 		}
 	}
 	return ""
 }
 
+// me pings with viewnum for the first time since it started. if every
+// server of the views since the last acked one failed, and that view's
+// primary comes back with the data it had, as a durable pbservice
+// server does, pinging with that view's number, it is primary again.
+func (vs *ViewServer) handleRejoin(me string, viewnum uint) {
+	if vs.impl.view.Primary != UNASSIGNED || vs.impl.acked == nil ||
+		vs.impl.acked.Primary != me || viewnum != vs.impl.acked.Viewnum {
+		return
+	}
+	vs.impl.used[me] = 1
+	vs.impl.nextView = makeView(vs.impl.view.Viewnum+1, me, nil)
+	vs.fillBackups(vs.impl.nextView)
+}
+
+// whether v makes the last acked view's primary primary again after
+// handleRejoin; it need not ack the current view, which has none.
+func (vs *ViewServer) rejoins(v *FullView) bool {
+	return vs.impl.view.Primary == UNASSIGNED && vs.impl.acked != nil && v.Primary == vs.impl.acked.Primary
+}
+
 func (vs *ViewServer) tryAdvanceView() {
-	if vs.impl.primaryViewNum == vs.impl.view.Viewnum && vs.impl.nextView != nil {
+	if vs.impl.nextView == nil {
+		return
+	}
+	if vs.leaseHeld(vs.impl.nextView) {
+		return
+	}
+	if vs.impl.primaryViewNum == vs.impl.view.Viewnum || vs.rejoins(vs.impl.nextView) {
+		if err := vs.saveView(vs.impl.nextView); err != nil {
+			fmt.Println("cannot save view, not advancing:", err)
+			return
+		}
 		vs.impl.view = vs.impl.nextView
 		vs.impl.nextView = nil
 		vs.impl.used[vs.impl.view.Primary] = 1
-		vs.impl.used[vs.impl.view.Backup] = 1
+		for _, backup := range vs.impl.view.Backups {
+			vs.impl.used[backup] = 1
+		}
 	}
 }
 